@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/mmirolim/gpp/macro"
+)
+
+// config project settings read from gpp.json or .gpp.toml
+// at module root, flags override them
+type config struct {
+	// regex matching filename:line of enabled Log_μ calls
+	Log string `json:"log" toml:"log"`
+	// package patterns to expand relative to module root
+	Patterns []string `json:"patterns" toml:"patterns"`
+	// if set only these macros are expanded
+	Enable []string `json:"enable" toml:"enable"`
+	// macros left as regular function calls
+	Disable []string `json:"disable" toml:"disable"`
+	// flags passed to go before command line flags
+	BuildFlags []string `json:"buildFlags" toml:"build_flags"`
+	// directory of expanded files and overlay for builds
+	BuildDir string `json:"buildDir" toml:"build_dir"`
+	// default output directory of expand command
+	ExpandDir string `json:"expandDir" toml:"expand_dir"`
+	// external executables expanding macros
+	Plugins []macro.Plugin `json:"plugins" toml:"plugins"`
+}
+
+// configFiles in order of lookup
+var configFiles = []string{"gpp.json", ".gpp.toml"}
+
+// loadConfig reads first found config file in root,
+// relative paths in config are resolved from root
+func loadConfig(root string) (*config, error) {
+	cfg := &config{}
+	for _, name := range configFiles {
+		fname := filepath.Join(root, name)
+		data, err := ioutil.ReadFile(fname)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(name, ".json") {
+			err = json.Unmarshal(data, cfg)
+		} else {
+			err = toml.Unmarshal(data, cfg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("config %s error %+v", fname, err)
+		}
+		break
+	}
+	for i, p := range cfg.Patterns {
+		if strings.HasPrefix(p, ".") {
+			cfg.Patterns[i] = filepath.Join(root, p)
+		}
+	}
+	for _, dir := range []*string{&cfg.BuildDir, &cfg.ExpandDir} {
+		if *dir != "" && !filepath.IsAbs(*dir) {
+			*dir = filepath.Join(root, *dir)
+		}
+	}
+	for i := range cfg.Plugins {
+		p := &cfg.Plugins[i]
+		// plugins run in root
+		p.Dir = root
+		if len(p.Command) > 0 && strings.HasPrefix(p.Command[0], ".") {
+			p.Command[0] = filepath.Join(root, p.Command[0])
+		}
+	}
+	return cfg, nil
+}
+
+// applyFlags overrides config values by flags set on command line
+func (cfg *config) applyFlags(set map[string]bool) {
+	if set["log"] {
+		cfg.Log = *logFlag
+	}
+	if set["enable"] {
+		cfg.Enable = splitList(*enableFlag)
+	}
+	if set["disable"] {
+		cfg.Disable = splitList(*disableFlag)
+	}
+	if set["builddir"] {
+		cfg.BuildDir = *buildDirFlag
+	}
+}
+
+// splitList splits comma separated list
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
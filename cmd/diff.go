@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mmirolim/gpp/expand"
+)
+
+// diffCmd prints unified diff of original and expanded sources
+// of packages or single file, expanded files are not written
+// usage: gpp diff [-macro] [file|packages]
+func diffCmd(args []string, ecfg expand.Config, cfg *config) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	macroOnly := fs.Bool("macro", false, "show only hunks with macro calls")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gpp diff [-macro] [file|packages]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	src := ecfg.Dir
+	var onlyFile string
+	patterns := fs.Args()
+	if len(patterns) == 1 && strings.HasSuffix(patterns[0], ".go") {
+		onlyFile = patterns[0]
+		if !filepath.IsAbs(onlyFile) {
+			onlyFile = filepath.Join(src, onlyFile)
+		}
+		// load package of the file
+		patterns = []string{"file=" + onlyFile}
+	}
+	if len(patterns) == 0 {
+		patterns = cfg.Patterns
+	}
+	if len(patterns) == 0 {
+		patterns = []string{"./..."}
+	}
+	ecfg.Patterns = patterns
+	ecfg.Tests = true
+	files, err := expandDir(ecfg, "")
+	if err != nil {
+		return err
+	}
+	fnames := make([]string, 0, len(files))
+	for fname := range files {
+		if onlyFile != "" && fname != onlyFile {
+			continue
+		}
+		fnames = append(fnames, fname)
+	}
+	sort.Strings(fnames)
+	for _, fname := range fnames {
+		f := files[fname]
+		rel, err := filepath.Rel(src, fname)
+		if err != nil {
+			return err
+		}
+		orig, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		out := unifiedDiff(orig, f.Src, "a/"+rel, "b/"+rel)
+		if *macroOnly {
+			out = filterHunks(out, f.MacroLines)
+		}
+		os.Stdout.Write(out)
+	}
+	return nil
+}
+
+// diffContext lines of context around changes in hunks
+const diffContext = 3
+
+// diffOp line of edit script, kind is ' ' for equal
+// line, '-' for deleted and '+' for inserted
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// unifiedDiff returns unified diff of a and b labeled as in
+// diff -u output, empty if they are equal
+func unifiedDiff(a, b []byte, labelA, labelB string) []byte {
+	ops := diffLines(splitLines(a), splitLines(b))
+	var out bytes.Buffer
+	// lines of a and b before op
+	lineA, lineB := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		lineA[i+1], lineB[i+1] = lineA[i], lineB[i]
+		if op.kind != '+' {
+			lineA[i+1]++
+		}
+		if op.kind != '-' {
+			lineB[i+1]++
+		}
+	}
+	for i := 0; i < len(ops); i++ {
+		if ops[i].kind == ' ' {
+			continue
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// hunks with changes closer than two contexts are joined
+		end, equal := i, 0
+		for ; end < len(ops) && equal <= 2*diffContext; end++ {
+			equal++
+			if ops[end].kind != ' ' {
+				equal = 0
+			}
+		}
+		end -= equal - diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", labelA, labelB)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(lineA[start], lineA[end]),
+			hunkRange(lineB[start], lineB[end]))
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return out.Bytes()
+}
+
+// hunkRange formats range of lines after from to to of hunk header
+func hunkRange(from, to int) string {
+	switch to - from {
+	case 0:
+		return fmt.Sprintf("%d,0", from)
+	case 1:
+		return strconv.Itoa(from + 1)
+	}
+	return fmt.Sprintf("%d,%d", from+1, to-from)
+}
+
+// splitLines splits src to lines with their newlines
+func splitLines(src []byte) []string {
+	var lines []string
+	for len(src) > 0 {
+		i := bytes.IndexByte(src, '\n') + 1
+		if i == 0 {
+			i = len(src)
+		}
+		lines = append(lines, string(src[:i]))
+		src = src[i:]
+	}
+	return lines
+}
+
+// diffLines returns shortest edit script of lines a to b
+// found by Myers algorithm
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	// furthest x on diagonals k = x - y in -d..d after d edits
+	var trace [][]int
+	for d := 0; len(trace) == 0 || !reached(trace, n, m); d++ {
+		v := make([]int, 2*d+1)
+		for k := -d; k <= d; k += 2 {
+			x := 0
+			if d > 0 {
+				x, _ = furthest(trace[d-1], d, k, n, m)
+			}
+			for y := x - k; x >= 0 && x < n && y < m && a[x] == b[y]; y++ {
+				x++
+			}
+			v[k+d] = x
+		}
+		trace = append(trace, v)
+	}
+	// walk back from end, ops are reversed
+	ops := make([]diffOp, 0, n+m)
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		prevX, prevY := 0, 0
+		if d > 0 {
+			_, prevK := furthest(trace[d-1], d, x-y, n, m)
+			prevX = trace[d-1][prevK+d-1]
+			prevY = prevX - prevK
+		}
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{'+', b[y-1]})
+		} else {
+			ops = append(ops, diffOp{'-', a[x-1]})
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// furthest returns x on diagonal k after d-th edit from furthest
+// path of prev round and diagonal of that path, x is -1 if paths
+// of prev round can not reach k inside n x m lines
+func furthest(prev []int, d, k, n, m int) (x, prevK int) {
+	x = -1
+	// insertion moves down from k+1
+	if k+1 <= d-1 && prev[k+1+d-1] >= 0 && prev[k+1+d-1]-k <= m {
+		x, prevK = prev[k+1+d-1], k+1
+	}
+	// deletion moves right from k-1
+	if k-1 >= 1-d && prev[k-1+d-1] >= 0 && prev[k-1+d-1] < n && prev[k-1+d-1]+1 > x {
+		x, prevK = prev[k-1+d-1]+1, k-1
+	}
+	return x, prevK
+}
+
+// reached checks if last round of trace reached end of a and b
+func reached(trace [][]int, n, m int) bool {
+	d := len(trace) - 1
+	k := n - m
+	return k >= -d && k <= d && (k+d)%2 == 0 && trace[d][k+d] == n
+}
+
+var hunkHeaderRe = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+\d+(?:,\d+)? @@`)
+
+// filterHunks keeps only hunks of unified diff which change
+// lines from original file set in lines
+func filterHunks(diff []byte, lines map[int]bool) []byte {
+	var header, hunk, out bytes.Buffer
+	keep := false
+	flush := func() {
+		if keep {
+			if header.Len() > 0 {
+				out.Write(header.Bytes())
+				header.Reset()
+			}
+			out.Write(hunk.Bytes())
+		}
+		hunk.Reset()
+		keep = false
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(diff))
+	scanner.Buffer(nil, 1<<20)
+	inHunk := false
+	origLine := 0
+	for scanner.Scan() {
+		ln := scanner.Text()
+		m := hunkHeaderRe.FindStringSubmatch(ln)
+		switch {
+		case m != nil:
+			flush()
+			inHunk = true
+			origLine, _ = strconv.Atoi(m[1])
+			hunk.WriteString(ln + "\n")
+			continue
+		case !inHunk:
+			header.WriteString(ln + "\n")
+			continue
+		}
+		hunk.WriteString(ln + "\n")
+		if strings.HasPrefix(ln, "+") || strings.HasPrefix(ln, "\\") {
+			continue
+		}
+		if strings.HasPrefix(ln, "-") && lines[origLine] {
+			keep = true
+		}
+		origLine++
+	}
+	flush()
+	return out.Bytes()
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mmirolim/gpp/expand"
+)
+
+// expandCmd expands macros in packages matched by patterns and writes
+// rewritten files to output directory keeping paths relative to srcDir,
+// nothing is built
+// usage: gpp expand -o ./_out [-line] [packages]
+func expandCmd(args []string, ecfg expand.Config, cfg *config) error {
+	fs := flag.NewFlagSet("expand", flag.ExitOnError)
+	outDir := fs.String("o", cfg.ExpandDir, "output directory for expanded files")
+	lineDirectives := fs.Bool("line", false, "emit //line directives mapping to original sources")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gpp expand -o dir [-line] [packages]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *outDir == "" {
+		fs.Usage()
+		return errors.New("output directory is required")
+	}
+	patterns := fs.Args()
+	if len(patterns) == 0 {
+		patterns = cfg.Patterns
+	}
+	if len(patterns) == 0 {
+		patterns = []string{"./..."}
+	}
+	src := ecfg.Dir
+	out, err := filepath.Abs(*outDir)
+	if err != nil {
+		return err
+	}
+	err = checkOutDir(src, out)
+	if err != nil {
+		return err
+	}
+	ecfg.Patterns = patterns
+	ecfg.LineDirectives = *lineDirectives
+	ecfg.Tests = true
+	files, err := expandDir(ecfg, src)
+	if err != nil {
+		return err
+	}
+	for fname, f := range files {
+		rel, err := filepath.Rel(src, fname)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(out, rel)
+		err = os.MkdirAll(filepath.Dir(dst), 0700)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(dst, f.Src, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkOutDir returns error if out is src or is in src and not
+// ignored by go command, otherwise expanded files written to out
+// are expanded and written again on next run
+func checkOutDir(src, out string) error {
+	if out == src {
+		return errors.New("output directory should differ from source directory")
+	}
+	if !expand.InDir(out, src) {
+		return nil
+	}
+	rel, err := filepath.Rel(src, out)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+			return nil
+		}
+	}
+	return fmt.Errorf("output directory %s is in source directory %s, its name should start with . or _", out, src)
+}
@@ -0,0 +1,251 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unicode"
+)
+
+// goCommand go subcommand delegated after macro expansion
+// gpp <go-subcommand> [go flags] [packages] [-- program args]
+type goCommand struct {
+	sub      string
+	flags    []string
+	pkgs     []string
+	progArgs []string
+}
+
+// overlayCmds go subcommands which accept build flags
+// and are run with expanded files overlay
+var overlayCmds = map[string]bool{
+	"build":    true,
+	"install":  true,
+	"run":      true,
+	"test":     true,
+	"vet":      true,
+	"list":     true,
+	"generate": true,
+}
+
+// valueFlags go flags which take value as next argument
+var valueFlags = map[string]bool{
+	"-C": true, "-o": true, "-p": true, "-tags": true, "-mod": true,
+	"-modfile": true, "-overlay": true, "-pkgdir": true, "-toolexec": true,
+	"-buildmode": true, "-compiler": true, "-installsuffix": true,
+	"-ldflags": true, "-gcflags": true, "-asmflags": true, "-gccgoflags": true,
+	"-pgo": true, "-covermode": true, "-coverpkg": true, "-exec": true,
+	"-run": true, "-skip": true, "-bench": true, "-benchtime": true,
+	"-count": true, "-cpu": true, "-parallel": true, "-timeout": true,
+	"-coverprofile": true, "-cpuprofile": true, "-memprofile": true,
+	"-memprofilerate": true, "-blockprofile": true, "-blockprofilerate": true,
+	"-mutexprofile": true, "-mutexprofilefraction": true, "-outputdir": true,
+	"-trace": true, "-vet": true, "-list": true, "-shuffle": true,
+	"-fuzz": true, "-fuzztime": true, "-fuzzminimizetime": true,
+	"-f": true,
+}
+
+// parseGoCommand splits args of go subcommand to go flags, packages
+// and program args after --, flags may be placed after packages
+func parseGoCommand(sub string, args []string) *goCommand {
+	c := &goCommand{sub: sub}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			c.progArgs = append(c.progArgs, args[i+1:]...)
+			return c
+		case strings.HasPrefix(arg, "-"):
+			c.flags = append(c.flags, arg)
+			// -flag value form
+			name := "-" + strings.TrimLeft(arg, "-")
+			if valueFlags[name] && i+1 < len(args) {
+				i++
+				c.flags = append(c.flags, args[i])
+			}
+		default:
+			c.pkgs = append(c.pkgs, arg)
+		}
+	}
+	return c
+}
+
+// legacyGoCommand maps -run and -test flags to go subcommand
+func legacyGoCommand() *goCommand {
+	switch {
+	case *testFlag:
+		return &goCommand{sub: "test", flags: []string{"-v"}, pkgs: []string{"./..."}}
+	case *runFlag:
+		return &goCommand{sub: "run", pkgs: []string{"."}}
+	default:
+		return &goCommand{sub: "build"}
+	}
+}
+
+// binary returns path of binary built for run subcommand
+func (c *goCommand) binary(dir, buildDir string) string {
+	name := filepath.Base(dir)
+	if len(c.pkgs) > 0 {
+		pkg := c.pkgs[0]
+		if !filepath.IsAbs(pkg) && strings.HasPrefix(pkg, ".") {
+			pkg = filepath.Join(dir, pkg)
+		}
+		name = strings.TrimSuffix(filepath.Base(pkg), ".go")
+	}
+	return filepath.Join(buildDir, overlayDirName, "bin", name)
+}
+
+// needTests reports whether go subcommand uses test files
+func (c *goCommand) needTests() bool {
+	return c.sub == "test" || c.sub == "vet"
+}
+
+// goCmd returns go command for sources in dir with expanded files
+// replaced by overlay, run subcommand is built as binary in buildDir
+func (c *goCommand) goCmd(dir, overlay, buildDir string, envs []string) *exec.Cmd {
+	sub := c.sub
+	var args []string
+	if overlayCmds[sub] {
+		args = append(args, "-overlay", overlay)
+	}
+	if sub == "run" {
+		// binary is run by gpp
+		sub = "build"
+		args = append(args, "-o", c.binary(dir, buildDir))
+	}
+	args = append(args, c.flags...)
+	args = append(args, c.pkgs...)
+	switch {
+	case c.sub == "run":
+	case c.sub == "test" && len(c.progArgs) > 0:
+		args = append(args, "-args")
+		args = append(args, c.progArgs...)
+	default:
+		args = append(args, c.progArgs...)
+	}
+	cmd := exec.Command("go", append([]string{sub}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = envs
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// paths of expanded files to original ones
+	translateOutput(cmd, overlay)
+	return cmd
+}
+
+// run executes go subcommand, for run subcommand
+// built binary is executed with program args
+func (c *goCommand) run(dir, overlay, buildDir string, envs []string) error {
+	err := runCmd(c.goCmd(dir, overlay, buildDir, envs))
+	if err != nil || c.sub != "run" {
+		return err
+	}
+	return runCmd(binaryCmd(c.binary(dir, buildDir), envs, c.progArgs))
+}
+
+// runCmd runs cmd and forwards SIGINT and SIGTERM to it
+// until it exits
+func runCmd(cmd *exec.Cmd) error {
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+	err = cmd.Wait()
+	flushOutput(cmd)
+	return err
+}
+
+// exitOnError exits with exit status of failed child process,
+// other errors are logged
+func exitOnError(sub string, err error) {
+	if err == nil {
+		return
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		log.Fatalf("go %s error %+v", sub, err)
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		// shell convention for killed process
+		os.Exit(128 + int(ws.Signal()))
+	}
+	os.Exit(exitErr.ExitCode())
+}
+
+// splitArgs splits s to args like shell does, args may be
+// quoted with single or double quotes and spaces escaped by backslash
+func splitArgs(s string) ([]string, error) {
+	var (
+		args  []string
+		arg   strings.Builder
+		inArg bool
+		quote rune
+		esc   bool
+	)
+	for _, r := range s {
+		switch {
+		case esc:
+			esc = false
+			if quote == '"' && r != '"' && r != '\\' && r != '$' && r != '`' {
+				arg.WriteRune('\\')
+			}
+			arg.WriteRune(r)
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+				continue
+			}
+			arg.WriteRune(r)
+		case r == '\\':
+			esc = true
+			inArg = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+				continue
+			}
+			arg.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || esc {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
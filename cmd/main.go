@@ -0,0 +1,278 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/mmirolim/gpp/expand"
+	"github.com/mmirolim/gpp/macro"
+)
+
+var (
+	dst       = flag.String("C", ".", "working directory")
+	runFlag   = flag.Bool("run", false, "run run binary")
+	testFlag  = flag.Bool("test", false, "test binary")
+	goArgs    = flag.String("args", "", "flags to go, shell quoted")
+	logFlag   = flag.String("log", "", "regex matching filename:line")
+	watchFlag = flag.Bool("watch", false, "rebuild on file changes")
+	// override gpp.json or .gpp.toml config
+	enableFlag   = flag.String("enable", "", "comma separated macros to expand, others are disabled")
+	disableFlag  = flag.String("disable", "", "comma separated macros to leave as function calls")
+	buildDirFlag = flag.String("builddir", "", "directory of expanded files and overlay")
+	jsonFlag     = flag.Bool("json", false, "print diagnostics as json lines")
+	strictFlag   = flag.Bool("strict", false, "fail on macro warnings")
+	// temp directory to use
+	tempDir = filepath.Join(os.TempDir(), "gpp_temp_build_dir")
+)
+
+// Expander of macro or macro type Name declared in package
+// ImportPath, added to expanders of gpp
+type Expander struct {
+	Name       string
+	ImportPath string
+	Expand     macro.MacroExpander
+}
+
+// Main runs gpp command with custom expanders
+func Main(expanders ...Expander) {
+	err := register(expanders)
+	if err != nil {
+		log.Fatalf("register expanders error %+v", err)
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: gpp [flags] [command] [go flags] [packages] [-- program args]
+
+Commands expand and diff are run by gpp, other commands are go subcommands
+run on expanded sources (build, install, run, test, vet, list, generate)
+or passed to go as is
+
+Flags:
+`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	dir, err := filepath.Abs(*dst)
+	if err != nil {
+		log.Fatalf("abs path error %+v", err)
+	}
+	envs := os.Environ()
+	sub := flag.Arg(0)
+	gc := legacyGoCommand()
+	if sub != "expand" && sub != "diff" {
+		if flag.NArg() > 0 {
+			if *runFlag || *testFlag {
+				// gpp -run -- program args
+				gc.progArgs = flag.Args()
+			} else {
+				gc = parseGoCommand(sub, flag.Args()[1:])
+			}
+		}
+		goFlags, err := splitArgs(*goArgs)
+		if err != nil {
+			log.Fatalf("-args error %+v", err)
+		}
+		gc.flags = append(gc.flags, goFlags...)
+		if !overlayCmds[gc.sub] {
+			// nothing to expand, delegate to go as is
+			err = runCmd(gc.goCmd(dir, "", "", envs))
+			exitOnError(gc.sub, err)
+			return
+		}
+	}
+	ws, err := expand.LoadWorkspace(dir)
+	if err != nil {
+		log.Fatalf("load workspace error %+v", err)
+	}
+	cfg, err := loadConfig(ws.Root)
+	if err != nil {
+		log.Fatalf("load config error %+v", err)
+	}
+	err = registerPlugins(cfg.Plugins)
+	if err != nil {
+		log.Fatalf("register plugins error %+v", err)
+	}
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	cfg.applyFlags(setFlags)
+	// settings shared by all expansions
+	ecfg := expand.Config{
+		Dir:       dir,
+		Enable:    cfg.Enable,
+		Disable:   cfg.Disable,
+		LocalDirs: ws.LocalDirs(),
+	}
+	if cfg.Log != "" {
+		ecfg.LogRe = regexp.MustCompile(cfg.Log)
+	}
+	switch sub {
+	case "expand":
+		err := expandCmd(flag.Args()[1:], ecfg, cfg)
+		if err != nil {
+			log.Fatalf("expand error %+v", err)
+		}
+		return
+	case "diff":
+		err := diffCmd(flag.Args()[1:], ecfg, cfg)
+		if err != nil {
+			log.Fatalf("diff error %+v", err)
+		}
+		return
+	}
+	// command line flags are after config ones to override them
+	gc.flags = append(append([]string{}, cfg.BuildFlags...), gc.flags...)
+	// expanded files and overlay path according to modulename
+	buildDir := cfg.BuildDir
+	if buildDir == "" {
+		buildDir = filepath.Join(tempDir, ws.Name())
+	}
+	buildDir, err = checkBuildDir(buildDir, ws.LocalDirs())
+	if err != nil {
+		log.Fatalf("build dir error %+v", err)
+	}
+	// only requested packages and their local dependencies,
+	// by default package in current directory like go command
+	if len(gc.pkgs) == 0 {
+		// go command gets packages of config expanded for it
+		gc.pkgs = cfg.Patterns
+	}
+	ecfg.Patterns = gc.pkgs
+	ecfg.LineDirectives = true
+	ecfg.Tests = gc.needTests()
+	files, err := expandDir(ecfg, "")
+	if err != nil {
+		log.Fatalf("expand dir error %+v", err)
+	}
+	if *watchFlag {
+		// outputs of gpp are not sources
+		skipDirs := []string{buildDir, cfg.ExpandDir}
+		err = watch(ws.Root, buildDir, skipDirs, gc, files, envs, ecfg)
+		if err != nil {
+			log.Fatalf("watch error %+v", err)
+		}
+		return
+	}
+	overlay, err := writeOverlay(buildDir, files)
+	if err != nil {
+		log.Fatalf("write overlay error %+v", err)
+	}
+	err = gc.run(dir, overlay, buildDir, envs)
+	exitOnError(gc.sub, err)
+}
+
+// register registers expanders, conflicts with registered
+// expanders and between expanders are errors
+func register(expanders []Expander) error {
+	for _, e := range expanders {
+		err := macro.Register(e.Name, e.ImportPath, e.Expand)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerPlugins registers expanders of macros of plugins
+func registerPlugins(plugins []macro.Plugin) error {
+	for _, p := range plugins {
+		expander, err := p.Expander()
+		if err != nil {
+			return err
+		}
+		for _, name := range p.Macros {
+			err = macro.Register(name, p.ImportPath, expander)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// binaryCmd returns command to run built binary
+func binaryCmd(bin string, envs, args []string) *exec.Cmd {
+	cmd := exec.Command(bin)
+	cmd.Args = append(cmd.Args, args...)
+	cmd.Env = envs
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// errStrict returned on macro warnings with -strict
+var errStrict = errors.New("macro expansion warnings in strict mode")
+
+// codeSkip code of warnings of expanded files not written
+const codeSkip = "skip"
+
+// expandDir expands macros by cfg, diagnostics are printed,
+// files outside of srcDir are skipped with warning if it is set
+func expandDir(cfg expand.Config, srcDir string) (map[string]*expand.File, error) {
+	res, err := expand.Expand(context.Background(), cfg)
+	if res != nil && srcDir != "" {
+		res.Diagnostics = append(res.Diagnostics, skipOutside(res.Files, srcDir)...)
+	}
+	if err == nil && *strictFlag && len(res.Diagnostics) > 0 {
+		err = errStrict
+	}
+	if res != nil {
+		printDiagnostics(os.Stderr, res.Diagnostics, err != nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.Files, nil
+}
+
+// skipOutside removes files outside of dir, workspace or replaced
+// modules, and returns warnings of removed files
+func skipOutside(files map[string]*expand.File, dir string) []expand.Diagnostic {
+	var fnames []string
+	for fname := range files {
+		if !expand.InDir(fname, dir) {
+			fnames = append(fnames, fname)
+		}
+	}
+	sort.Strings(fnames)
+	diags := make([]expand.Diagnostic, 0, len(fnames))
+	for _, fname := range fnames {
+		delete(files, fname)
+		diags = append(diags, expand.Diagnostic{
+			Severity: macro.Warning,
+			Code:     codeSkip,
+			Message:  fmt.Sprintf("skip %s outside of %s", fname, dir),
+		})
+	}
+	return diags
+}
+
+// printDiagnostics prints diagnostics in file:line:col form
+// or as json lines with -json
+func printDiagnostics(w io.Writer, diags []expand.Diagnostic, failed bool) {
+	if *jsonFlag {
+		enc := json.NewEncoder(w)
+		for _, d := range diags {
+			enc.Encode(d)
+		}
+		return
+	}
+	if failed {
+		fmt.Fprintln(w, "\n=======\033[31m Build Failed \033[39m=======")
+	}
+	for _, d := range diags {
+		fmt.Fprintln(w, d)
+	}
+	if failed {
+		fmt.Fprintln(w, "\n============================")
+	}
+}
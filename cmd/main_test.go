@@ -0,0 +1,920 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"go/ast"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmirolim/gpp/expand"
+	"github.com/mmirolim/gpp/macro"
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+func TestMacro(t *testing.T) {
+	// Setup start
+	testDir := filepath.Join(os.TempDir(), "gpp-test-macro")
+	// clean before running
+	os.RemoveAll(testDir)
+	src, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatalf("abs error %+v", err)
+	}
+	// Setup end
+	defer func() {
+		if !t.Failed() {
+			// let check directory on fail
+			os.RemoveAll(testDir)
+		}
+	}()
+	cases := []struct {
+		desc   string
+		srcDir string
+		output string
+		err    error
+	}{
+		{
+			desc:   "Test NewSeq M/F/R fluent api",
+			srcDir: filepath.Join(src, "testdata", "newseq"),
+			output: `
+NewSeq Map/Filter [{strLen:3} {strLen:4}]
+NewSeq res [2] sum even 12 mult even 48
+Map_μ [2 3 4]
+Upper_μ [#GO #PP]
+Last_μ {strLen:4} Zip_μ map[#GO:1 #PP:2]
+Keys_μ [#GO #PP] 2
+Index_μ 1 -1
+# chain
+# 2
+2 2
+count 5
+2
+3
+4
+`,
+			err: nil,
+		},
+		{
+			desc:   "Test try_μ",
+			srcDir: filepath.Join(src, "testdata", "try"),
+			output: `
+(result, err) = (1, fErr: fErr error)
+(result, err) = (1, <nil>)
+return err = fStrError: fStrError error
+if err = fErr: fErr error
+arg err = <nil>
+renamed err = fErr: fErr error
+shadowed err = fErr: fErr error
+`,
+			err: nil,
+		},
+		{
+			desc:   "Test log_μ",
+			srcDir: filepath.Join(src, "testdata", "log"),
+			output: `
+/main.go:16 result before result=0
+/main.go:18 result after result=10
+/main.go:22 err, slice and index err=<nil> a=[][2]int{[2]int{1, 2}} a[0]=[2]int{1, 2}
+/main.go:23 func calls sl(10)[0]=10 strr('hello')="hello"
+/lib/lib.go:8 LogLibFunc val=20
+/main.go:25 lib calls lib.LogLibFuncA(20)=20
+/main.go:26 value macro len(macro.Keys_μ(map[int]int{1: 1}))=1
+/alias.go:14 package alias n=1
+/alias.go:15 chained alias n + 1=2
+/main.go:27 deferred len(a)=1
+`,
+			err: nil,
+		},
+		{
+			desc:   "Test plugin macros",
+			srcDir: filepath.Join(src, "testdata", "plugin"),
+			output: `square 9
+func main() GPP
+func main() DEFER
+`,
+			err: nil,
+		},
+		{
+			desc:   "Test compiler directives",
+			srcDir: filepath.Join(src, "testdata", "directives"),
+			output: `/main.go:21 msg msg="embedded\n"
+embedded
+4
+`,
+			err: nil,
+		},
+	}
+
+	var buf bytes.Buffer
+	for i, tc := range cases {
+		buf.Reset()
+		cfg, err := loadConfig(tc.srcDir)
+		if isUnexpectedErr(t, i, tc.desc, nil, err) {
+			continue
+		}
+		err = registerPlugins(cfg.Plugins)
+		defer unregisterPlugins(cfg.Plugins)
+		if isUnexpectedErr(t, i, tc.desc, nil, err) {
+			continue
+		}
+		files, err := expandDir(expand.Config{
+			Dir:            tc.srcDir,
+			Patterns:       []string{"./..."},
+			LineDirectives: true,
+		}, "")
+		if isUnexpectedErr(t, i, tc.desc, tc.err, err) {
+			continue
+		}
+		buildDir := filepath.Join(testDir, filepath.Base(tc.srcDir))
+		overlay, err := writeOverlay(buildDir, files)
+		if isUnexpectedErr(t, i, tc.desc, nil, err) {
+			continue
+		}
+		bin := filepath.Join(buildDir, "main")
+		cmd := exec.Command("go", "build", "-overlay", overlay, "-o", bin, ".")
+		cmd.Dir = tc.srcDir
+		cmd.Stdout = &buf
+		cmd.Stderr = &buf
+		err = cmd.Run()
+		output := buf.String()
+		if isUnexpectedErr(t, i, tc.desc, nil, err) {
+			t.Errorf("cmd args %v\n%s", cmd.Args, output)
+			continue
+		}
+		buf.Reset()
+		// run binary
+		cmd = exec.Command(bin)
+		cmd.Stdout = &buf
+		cmd.Stderr = &buf
+		err = cmd.Run()
+		output = buf.String()
+		if isUnexpectedErr(t, i, tc.desc, nil, err) {
+			t.Errorf("cmd args %v\n%s", cmd.Args, output)
+			continue
+		}
+		if output != tc.output {
+			t.Errorf("case [%d] %s\nexpected %s, got %s", i, tc.desc, tc.output, output)
+		}
+	}
+}
+
+func unregisterPlugins(plugins []macro.Plugin) {
+	for _, p := range plugins {
+		for _, name := range p.Macros {
+			delete(macro.MacroExpanders, macro.MacroKey(p.ImportPath, name))
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	cases := []struct {
+		desc string
+		in   string
+		out  []string
+		err  error
+	}{
+		{desc: "empty", in: "", out: nil},
+		{desc: "spaces", in: "  -race   -v ", out: []string{"-race", "-v"}},
+		{desc: "quoted", in: `-ldflags "-X main.v=1 -s" -tags 'a b'`,
+			out: []string{"-ldflags", "-X main.v=1 -s", "-tags", "a b"}},
+		{desc: "escaped", in: `a\ b "c\"d" ''`, out: []string{"a b", `c"d`, ""}},
+		{desc: "unterminated", in: `"a`,
+			err: errors.New(`unterminated quote or escape in "\"a"`)},
+	}
+	for i, tc := range cases {
+		out, err := splitArgs(tc.in)
+		if isUnexpectedErr(t, i, tc.desc, tc.err, err) {
+			continue
+		}
+		if !reflect.DeepEqual(out, tc.out) {
+			t.Errorf("case [%d] %s\nexpected %q, got %q", i, tc.desc, tc.out, out)
+		}
+	}
+}
+
+func TestParseGoCommand(t *testing.T) {
+	type testCase struct {
+		desc string
+		sub  string
+		in   string
+		out  *goCommand
+	}
+	cases := []testCase{
+		{desc: "empty", sub: "build", in: "", out: &goCommand{sub: "build"}},
+		{desc: "test flags after packages", sub: "test", in: "./... -run X -count=1",
+			out: &goCommand{sub: "test", flags: []string{"-run", "X", "-count=1"}, pkgs: []string{"./..."}}},
+		{desc: "output", sub: "build", in: "-o out -v ./cmd",
+			out: &goCommand{sub: "build", flags: []string{"-o", "out", "-v"}, pkgs: []string{"./cmd"}}},
+		{desc: "double dash flag", sub: "build", in: "--tags integration .",
+			out: &goCommand{sub: "build", flags: []string{"--tags", "integration"}, pkgs: []string{"."}}},
+		{desc: "program args", sub: "run", in: ". -race -- -v --x -- y",
+			out: &goCommand{sub: "run", flags: []string{"-race"}, pkgs: []string{"."},
+				progArgs: []string{"-v", "--x", "--", "y"}}},
+		{desc: "no program args", sub: "run", in: "main.go --",
+			out: &goCommand{sub: "run", pkgs: []string{"main.go"}}},
+		{desc: "missing value", sub: "build", in: ". -o",
+			out: &goCommand{sub: "build", flags: []string{"-o"}, pkgs: []string{"."}}},
+	}
+	for name := range valueFlags {
+		cases = append(cases, testCase{desc: "value of " + name, sub: "test", in: name + " v ./...",
+			out: &goCommand{sub: "test", flags: []string{name, "v"}, pkgs: []string{"./..."}}})
+	}
+	for i, tc := range cases {
+		args, err := splitArgs(tc.in)
+		if isUnexpectedErr(t, i, tc.desc, nil, err) {
+			continue
+		}
+		out := parseGoCommand(tc.sub, args)
+		if !reflect.DeepEqual(out, tc.out) {
+			t.Errorf("case [%d] %s\nexpected %+v, got %+v", i, tc.desc, tc.out, out)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	noop := func(ctx *macro.Context, cur *astutil.Cursor, parentStmt ast.Stmt,
+		idents []*ast.Ident, callArgs [][]ast.Expr) bool {
+		return false
+	}
+	const path = "gpp.com/register"
+	defer func() {
+		for _, name := range []string{"A_μ", "B_μ"} {
+			delete(macro.MacroExpanders, macro.MacroKey(path, name))
+		}
+	}()
+	cases := []struct {
+		desc      string
+		expanders []Expander
+		err       error
+	}{
+		{desc: "new", expanders: []Expander{{"A_μ", path, noop}}},
+		{desc: "registered", expanders: []Expander{{"A_μ", path, noop}},
+			err: errors.New("expander of macro gpp.com/register.A_μ is already registered")},
+		{desc: "builtin", expanders: []Expander{{"Try_μ", macro.MacroPkgPath, noop}},
+			err: errors.New("expander of macro github.com/mmirolim/gpp/macro.Try_μ is already registered")},
+		{desc: "duplicate", expanders: []Expander{{"B_μ", path, noop}, {"B_μ", path, noop}},
+			err: errors.New("expander of macro gpp.com/register.B_μ is already registered")},
+		{desc: "no suffix", expanders: []Expander{{"C", path, noop}},
+			err: errors.New("macro gpp.com/register.C has no _μ suffix")},
+		{desc: "nil", expanders: []Expander{{"D_μ", path, nil}},
+			err: errors.New("nil expander of macro gpp.com/register.D_μ")},
+	}
+	for i, tc := range cases {
+		err := register(tc.expanders)
+		isUnexpectedErr(t, i, tc.desc, tc.err, err)
+	}
+}
+
+func TestOutputTranslator(t *testing.T) {
+	buildDir, err := ioutil.TempDir("", "gpp-test-translate")
+	if err != nil {
+		t.Fatalf("temp dir error %+v", err)
+	}
+	defer os.RemoveAll(buildDir)
+	orig := "/src/app/main.go"
+	files := map[string]*expand.File{
+		orig: {Src: []byte("package main\n\n//line /src/app/main.go:10\nfunc main() {\n\tf()\n}\n")},
+	}
+	overlay, err := writeOverlay(buildDir, files)
+	if err != nil {
+		t.Fatalf("write overlay error %+v", err)
+	}
+	expanded := overlayFile(buildDir, orig)
+	cases := []struct {
+		desc string
+		in   string
+		out  string
+	}{
+		{desc: "before directive", in: expanded + ":1:1: error\n", out: orig + ":1:1: error\n"},
+		{desc: "after directive", in: "# app\n" + expanded + ":5:2: undefined: f\n",
+			out: "# app\n" + orig + ":11:2: undefined: f\n"},
+		{desc: "relative", in: "./src/app/main.go:4", out: orig + ":10"},
+		{desc: "no line", in: "open " + expanded + ": denied", out: "open " + orig + ": denied"},
+		{desc: "other", in: "/src/app/main.go:4:1: x\n", out: "/src/app/main.go:4:1: x\n"},
+	}
+	var buf bytes.Buffer
+	for i, tc := range cases {
+		buf.Reset()
+		tr, err := newOutputTranslator(&buf, overlay, filepath.Join(buildDir, overlayDirName, "src"))
+		if isUnexpectedErr(t, i, tc.desc, nil, err) {
+			continue
+		}
+		tr.Write([]byte(tc.in))
+		tr.Flush()
+		if buf.String() != tc.out {
+			t.Errorf("case [%d] %s\nexpected %q, got %q", i, tc.desc, tc.out, buf.String())
+		}
+	}
+}
+
+func isUnexpectedErr(t *testing.T, caseID int, desc string, expectedErr, goterr error) bool {
+	t.Helper()
+	var eStr, gotStr string
+	if expectedErr != nil {
+		eStr = expectedErr.Error()
+	}
+	if goterr != nil {
+		gotStr = goterr.Error()
+	}
+
+	if eStr != gotStr {
+		t.Errorf("case [%d] %s\nexpected error \"%s\"\ngot \"%s\"", caseID, desc, eStr, gotStr)
+		return true
+	}
+	return false
+}
+
+func TestExpandDiagnostics(t *testing.T) {
+	src, err := filepath.Abs(filepath.Join("testdata", "diag"))
+	if err != nil {
+		t.Fatalf("abs error %+v", err)
+	}
+	res, err := expand.Expand(context.Background(), expand.Config{Dir: src})
+	if err != expand.ErrExpand {
+		t.Fatalf("expected error %v, got %v", expand.ErrExpand, err)
+	}
+	var diags []string
+	for _, d := range res.Diagnostics {
+		diags = append(diags, d.String())
+	}
+	expected := []string{
+		filepath.Join(src, "double.go") + ":6:6: error[invalid-decl]: Double_μ refers to unexported " +
+			"double of package gpp.com/diag/lib",
+		filepath.Join(src, "main.go") + ":20:22: error[invalid-arg]: Try_μ expects func literal argument",
+		filepath.Join(src, "main.go") + ":27:8: error[type-param]: MapKeys_μ: ambiguous type of _T, " +
+			"string by argument 1 and int by argument 2",
+		filepath.Join(src, "main.go") + ":29:32: error[invalid-call]: Keys_μ can not be hoisted " +
+			"before statement preserving evaluation order",
+		filepath.Join(src, "show.go") + ":6:6: error[invalid-arg]: Show_μ expects 1 arguments",
+		filepath.Join(src, "main.go") + ":24:22: error[type]: NewSeq_μ: in Map with argument " +
+			"(func(s string) string literal): cannot use input_6[i_9] (variable of type int) as string value in argument to fun_8",
+	}
+	if !reflect.DeepEqual(diags, expected) {
+		t.Errorf("expected diagnostics\n%q\ngot\n%q", expected, diags)
+	}
+}
+
+func TestExpandPanic(t *testing.T) {
+	src, err := filepath.Abs(filepath.Join("testdata", "diag"))
+	if err != nil {
+		t.Fatalf("abs error %+v", err)
+	}
+	const path = "gpp.com/diag/lib"
+	fail := func(ctx *macro.Context, cur *astutil.Cursor, parentStmt ast.Stmt,
+		idents []*ast.Ident, callArgs [][]ast.Expr) bool {
+		panic("bad expander")
+	}
+	err = register([]Expander{{"Show_μ", path, fail}})
+	if err != nil {
+		t.Fatalf("register error %+v", err)
+	}
+	defer delete(macro.MacroExpanders, macro.MacroKey(path, "Show_μ"))
+	res, err := expand.Expand(context.Background(), expand.Config{Dir: src})
+	if err != expand.ErrExpand {
+		t.Fatalf("expected error %v, got %v", expand.ErrExpand, err)
+	}
+	expected := filepath.Join(src, "show.go") + ":1:1: error[panic]: expand panic bad expander"
+	found := false
+	for _, d := range res.Diagnostics {
+		found = found || d.String() == expected
+	}
+	if !found {
+		t.Errorf("expected diagnostic %q in %q", expected, res.Diagnostics)
+	}
+	if _, ok := res.Files[filepath.Join(src, "show.go")]; ok {
+		t.Errorf("expected show.go not expanded")
+	}
+}
+
+func TestSkipOutside(t *testing.T) {
+	files := map[string]*expand.File{
+		"/src/app/main.go":      {},
+		"/src/app/lib/lib.go":   {},
+		"/src/lib/lib.go":       {},
+		"/src/application/a.go": {},
+	}
+	diags := skipOutside(files, "/src/app")
+	var out []string
+	for _, d := range diags {
+		out = append(out, d.String())
+	}
+	expected := []string{
+		"warning[skip]: skip /src/application/a.go outside of /src/app",
+		"warning[skip]: skip /src/lib/lib.go outside of /src/app",
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected diagnostics\n%q\ngot\n%q", expected, out)
+	}
+	if len(files) != 2 || files["/src/app/main.go"] == nil || files["/src/app/lib/lib.go"] == nil {
+		t.Errorf("expected files of /src/app, got %v", files)
+	}
+}
+
+// writeTree writes files by paths relative to root
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for name, src := range files {
+		fname := filepath.Join(root, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(fname), 0700)
+		if err == nil {
+			err = ioutil.WriteFile(fname, []byte(src), 0600)
+		}
+		if err != nil {
+			t.Fatalf("write %s error %+v", fname, err)
+		}
+	}
+}
+
+func TestLoadWorkspace(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gpp-test-workspace")
+	if err != nil {
+		t.Fatalf("temp dir error %+v", err)
+	}
+	defer os.RemoveAll(tmp)
+	// go command reports resolved paths
+	tmp, err = filepath.EvalSymlinks(tmp)
+	if err != nil {
+		t.Fatalf("eval symlinks error %+v", err)
+	}
+	gopath := os.Getenv("GOPATH")
+	defer os.Setenv("GOPATH", gopath)
+	path := func(rel string) string { return filepath.Join(tmp, filepath.FromSlash(rel)) }
+	writeTree(t, tmp, map[string]string{
+		"mod/go.mod":                "module gpp.com/mod\n\ngo 1.13\n\nreplace gpp.com/dep => ../dep\n\nreplace gpp.com/v => gpp.com/w v1.0.0\n",
+		"mod/pkg/a.go":              "package pkg\n",
+		"dep/go.mod":                "module gpp.com/dep\n",
+		"work/go.work":              "go 1.18\n\nuse ./a\n\nuse ./b\n\nreplace gpp.com/dep => ../dep\n",
+		"work/a/go.mod":             "module gpp.com/a\n\ngo 1.18\n",
+		"work/b/go.mod":             "module gpp.com/b\n\ngo 1.18\n",
+		"gopath/src/gpp.com/p/p.go": "package p\n",
+		"other/src/gpp.com/q/q.go":  "package q\n",
+	})
+	cases := []struct {
+		desc   string
+		dir    string
+		gopath string
+		ws     *expand.Workspace
+		err    error
+	}{
+		{desc: "go.mod", dir: path("mod/pkg"), ws: &expand.Workspace{
+			Root:     path("mod"),
+			Modules:  []expand.Module{{Path: "gpp.com/mod", Dir: path("mod")}},
+			Replaced: []string{path("dep")},
+		}},
+		{desc: "go.work", dir: path("work/b"), ws: &expand.Workspace{
+			Root: path("work"),
+			Modules: []expand.Module{
+				{Path: "gpp.com/a", Dir: path("work/a")},
+				{Path: "gpp.com/b", Dir: path("work/b")},
+			},
+			Replaced: []string{path("dep")},
+		}},
+		{desc: "GOPATH", dir: path("gopath/src/gpp.com/p"), gopath: path("gopath"), ws: &expand.Workspace{
+			Root:    path("gopath/src/gpp.com/p"),
+			Modules: []expand.Module{{Path: "gpp.com/p", Dir: path("gopath/src/gpp.com/p")}},
+		}},
+		{desc: "GOPATH list", dir: path("other/src/gpp.com/q"),
+			gopath: path("gopath") + string(filepath.ListSeparator) + path("other"), ws: &expand.Workspace{
+				Root:    path("other/src/gpp.com/q"),
+				Modules: []expand.Module{{Path: "gpp.com/q", Dir: path("other/src/gpp.com/q")}},
+			}},
+		{desc: "outside GOPATH", dir: path("other/src/gpp.com/q"), gopath: path("gopath"),
+			err: errors.New("go.mod not found and " + path("other/src/gpp.com/q") +
+				" is not in src of GOPATH " + path("gopath"))},
+	}
+	for i, tc := range cases {
+		env := gopath
+		if tc.gopath != "" {
+			env = tc.gopath
+		}
+		os.Setenv("GOPATH", env)
+		ws, err := expand.LoadWorkspace(tc.dir)
+		if isUnexpectedErr(t, i, tc.desc, tc.err, err) {
+			continue
+		}
+		if !reflect.DeepEqual(ws, tc.ws) {
+			t.Errorf("case [%d] %s\nexpected %+v\ngot %+v", i, tc.desc, tc.ws, ws)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gpp-test-config")
+	if err != nil {
+		t.Fatalf("temp dir error %+v", err)
+	}
+	defer os.RemoveAll(tmp)
+	path := func(rel string) string { return filepath.Join(tmp, filepath.FromSlash(rel)) }
+	writeTree(t, tmp, map[string]string{
+		"json/gpp.json": `{"log": "main.go", "patterns": ["./cmd/...", "gpp.com/x"],
+			"disable": ["Log_μ"], "buildDir": "build", "expandDir": "/out",
+			"plugins": [{"command": ["./plugin", "-v"], "importPath": "gpp.com/p", "macros": ["P_μ"]}]}`,
+		"toml/.gpp.toml": "log = \"lib\"\nenable = [\"Try_μ\"]\nbuild_flags = [\"-race\"]\nexpand_dir = \"out\"\n",
+		"both/gpp.json":  `{"log": "json"}`,
+		"both/.gpp.toml": "log = \"toml\"\n",
+		"bad/gpp.json":   `{"log": 1}`,
+	})
+	cases := []struct {
+		desc  string
+		root  string
+		flags map[string]string
+		cfg   *config
+		err   error
+	}{
+		{desc: "none", root: path("none"), cfg: &config{}},
+		{desc: "json", root: path("json"), cfg: &config{
+			Log:      "main.go",
+			Patterns: []string{path("json/cmd/..."), "gpp.com/x"},
+			Disable:  []string{"Log_μ"},
+			BuildDir: path("json/build"), ExpandDir: "/out",
+			Plugins: []macro.Plugin{{Command: []string{path("json/plugin"), "-v"},
+				ImportPath: "gpp.com/p", Macros: []string{"P_μ"}, Dir: path("json")}},
+		}},
+		{desc: "toml", root: path("toml"), cfg: &config{
+			Log: "lib", Enable: []string{"Try_μ"},
+			BuildFlags: []string{"-race"}, ExpandDir: path("toml/out"),
+		}},
+		{desc: "json before toml", root: path("both"), cfg: &config{Log: "json"}},
+		{desc: "flags override", root: path("json"),
+			flags: map[string]string{"log": "flag.go", "disable": "", "enable": "Try, Log_μ", "builddir": "/build"},
+			cfg: &config{
+				Log:      "flag.go",
+				Patterns: []string{path("json/cmd/..."), "gpp.com/x"},
+				Enable:   []string{"Try", "Log_μ"},
+				BuildDir: "/build", ExpandDir: "/out",
+				Plugins: []macro.Plugin{{Command: []string{path("json/plugin"), "-v"},
+					ImportPath: "gpp.com/p", Macros: []string{"P_μ"}, Dir: path("json")}},
+			}},
+		{desc: "invalid", root: path("bad"), err: errors.New("config " + path("bad/gpp.json") +
+			" error json: cannot unmarshal number into Go struct field config.log of type string")},
+	}
+	defer func() {
+		for _, name := range []string{"log", "enable", "disable", "builddir"} {
+			flag.Set(name, "")
+		}
+	}()
+	for i, tc := range cases {
+		cfg, err := loadConfig(tc.root)
+		if isUnexpectedErr(t, i, tc.desc, tc.err, err) || err != nil {
+			continue
+		}
+		set := map[string]bool{}
+		for name, v := range tc.flags {
+			flag.Set(name, v)
+			set[name] = true
+		}
+		cfg.applyFlags(set)
+		if !reflect.DeepEqual(cfg, tc.cfg) {
+			t.Errorf("case [%d] %s\nexpected %+v\ngot %+v", i, tc.desc, tc.cfg, cfg)
+		}
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	lines := func(from, to int) string {
+		var s string
+		for i := from; i <= to; i++ {
+			s += strconv.Itoa(i) + "\n"
+		}
+		return s
+	}
+	cases := []struct {
+		desc string
+		a, b string
+		out  string
+	}{
+		{desc: "equal", a: lines(1, 5), b: lines(1, 5), out: ""},
+		{desc: "change", a: lines(1, 10), b: lines(1, 4) + "x\n" + lines(6, 10),
+			out: "--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+x\n 6\n 7\n 8\n"},
+		{desc: "insert and delete", a: lines(1, 3), b: "0\n" + lines(1, 2),
+			out: "--- a\n+++ b\n@@ -1,3 +1,3 @@\n+0\n 1\n 2\n-3\n"},
+		{desc: "far hunks", a: lines(1, 20), b: "x\n" + lines(2, 19) + "y\n",
+			out: "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n" +
+				"@@ -17,4 +17,4 @@\n 17\n 18\n 19\n-20\n+y\n"},
+		{desc: "joined hunks", a: lines(1, 10), b: "x\n" + lines(2, 7) + "y\n" + lines(9, 10),
+			out: "--- a\n+++ b\n@@ -1,10 +1,10 @@\n-1\n+x\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+y\n 9\n 10\n"},
+		{desc: "empty", a: "", b: "x\n", out: "--- a\n+++ b\n@@ -0,0 +1 @@\n+x\n"},
+		{desc: "no newline", a: "1\n2", b: "1\n2\n",
+			out: "--- a\n+++ b\n@@ -1,2 +1,2 @@\n 1\n-2\n\\ No newline at end of file\n+2\n"},
+	}
+	for i, tc := range cases {
+		out := string(unifiedDiff([]byte(tc.a), []byte(tc.b), "a", "b"))
+		if out != tc.out {
+			t.Errorf("case [%d] %s\nexpected\n%s\ngot\n%s", i, tc.desc, tc.out, out)
+		}
+	}
+}
+
+func TestFilterHunks(t *testing.T) {
+	diff := "--- a/main.go\n+++ b/main.go\n" +
+		"@@ -1,4 +1,4 @@\n 1\n-2\n+x\n 3\n 4\n" +
+		"@@ -10,3 +10,4 @@\n 10\n+y\n-11\n+z\n 12\n" +
+		"@@ -20,2 +21,2 @@\n 20\n-21\n\\ No newline at end of file\n+21\n"
+	cases := []struct {
+		desc  string
+		lines map[int]bool
+		out   string
+	}{
+		{desc: "none", lines: map[int]bool{1: true, 12: true}, out: ""},
+		{desc: "first", lines: map[int]bool{2: true},
+			out: "--- a/main.go\n+++ b/main.go\n@@ -1,4 +1,4 @@\n 1\n-2\n+x\n 3\n 4\n"},
+		{desc: "after insert", lines: map[int]bool{11: true},
+			out: "--- a/main.go\n+++ b/main.go\n@@ -10,3 +10,4 @@\n 10\n+y\n-11\n+z\n 12\n"},
+		{desc: "no newline", lines: map[int]bool{2: true, 21: true},
+			out: "--- a/main.go\n+++ b/main.go\n@@ -1,4 +1,4 @@\n 1\n-2\n+x\n 3\n 4\n" +
+				"@@ -20,2 +21,2 @@\n 20\n-21\n\\ No newline at end of file\n+21\n"},
+	}
+	for i, tc := range cases {
+		out := string(filterHunks([]byte(diff), tc.lines))
+		if out != tc.out {
+			t.Errorf("case [%d] %s\nexpected\n%s\ngot\n%s", i, tc.desc, tc.out, out)
+		}
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	src, err := filepath.Abs(filepath.Join("testdata", "directives"))
+	if err != nil {
+		t.Fatalf("abs error %+v", err)
+	}
+	res, err := expand.Expand(context.Background(), expand.Config{Dir: src})
+	if err != nil {
+		t.Fatalf("expand error %+v", err)
+	}
+	f := res.Files[filepath.Join(src, "main.go")]
+	if f == nil {
+		t.Fatalf("main.go is not expanded")
+	}
+	expected := `//go:build !skip
+// +build !skip
+
+// Package main keeps compiler directives in expanded source
+package main
+
+import (
+	_ "embed"
+	"fmt"
+)
+
+//go:generate echo generate
+
+//go:embed msg.txt
+var msg string
+
+func main() {
+	// log of embedded file
+	fmt.Printf("/main.go:21 %v msg=%#v\n", "msg", msg)
+	fmt.Print(msg, twice(2), "\n")
+}
+
+//go:noinline
+func twice(v int) int {
+	var result_1 []int
+	{
+		dic_2 := map[int]int{v: 1, 2 * v: 2}
+		keys_3 := make([]int, 0, len(dic_2))
+		for k_4 := range dic_2 {
+			keys_3 = append(keys_3, k_4)
+		}
+		result_1 = keys_3
+	}
+	return v * len(result_1)
+}
+`
+	if string(f.Src) != expected {
+		t.Errorf("expected source\n%s\ngot\n%s", expected, f.Src)
+	}
+}
+
+func TestDiffTree(t *testing.T) {
+	t0 := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Second)
+	cases := []struct {
+		desc     string
+		old, cur map[string]time.Time
+		changed  []string
+		removed  []string
+	}{
+		{desc: "same", old: map[string]time.Time{"a.go": t0}, cur: map[string]time.Time{"a.go": t0}},
+		{desc: "changed", old: map[string]time.Time{"a.go": t0, "b.go": t0},
+			cur: map[string]time.Time{"a.go": t1, "b.go": t0}, changed: []string{"a.go"}},
+		{desc: "new and removed", old: map[string]time.Time{"a.go": t0, "lib/b.go": t0},
+			cur:     map[string]time.Time{"a.go": t0, "go.mod": t1, "lib/c.go": t1},
+			changed: []string{"go.mod", "lib/c.go"}, removed: []string{"lib/b.go"}},
+		{desc: "all removed", old: map[string]time.Time{"a.go": t0}, cur: map[string]time.Time{},
+			removed: []string{"a.go"}},
+	}
+	for i, tc := range cases {
+		changed, removed := diffTree(tc.old, tc.cur)
+		sort.Strings(changed)
+		sort.Strings(removed)
+		if !reflect.DeepEqual(changed, tc.changed) || !reflect.DeepEqual(removed, tc.removed) {
+			t.Errorf("case [%d] %s\nexpected %q %q, got %q %q",
+				i, tc.desc, tc.changed, tc.removed, changed, removed)
+		}
+	}
+}
+
+func TestScanTree(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gpp-test-scan")
+	if err != nil {
+		t.Fatalf("temp dir error %+v", err)
+	}
+	defer os.RemoveAll(tmp)
+	writeTree(t, tmp, map[string]string{
+		"go.mod":                      "module gpp.com/scan\n",
+		"main.go":                     "package main\n",
+		"README.md":                   "readme\n",
+		"a/a.go":                      "package a\n",
+		".git/x.go":                   "package x\n",
+		"build/.gpp-overlay/src/a.go": "package a\n",
+		"build/b.go":                  "package b\n",
+		"out/main.go":                 "package main\n",
+	})
+	modTimes, err := scanTree(tmp, []string{filepath.Join(tmp, "build"), filepath.Join(tmp, "out"), ""})
+	if err != nil {
+		t.Fatalf("scan error %+v", err)
+	}
+	var fnames []string
+	for fname := range modTimes {
+		fnames = append(fnames, filepath.ToSlash(fname))
+	}
+	sort.Strings(fnames)
+	expected := []string{"a/a.go", "go.mod", "main.go"}
+	if !reflect.DeepEqual(expected, fnames) {
+		t.Errorf("expected %v, got %v", expected, fnames)
+	}
+}
+
+func TestReexpand(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gpp-test-watch")
+	if err != nil {
+		t.Fatalf("temp dir error %+v", err)
+	}
+	defer os.RemoveAll(tmp)
+	tmp, err = filepath.EvalSymlinks(tmp)
+	if err != nil {
+		t.Fatalf("eval symlinks error %+v", err)
+	}
+	src := func(pkg, arg string) string {
+		return "package " + pkg + "\n\nimport \"gpp.com/watch/lib\"\n\nfunc f() {\n\tlib.Print_μ(" + arg + ")\n}\n"
+	}
+	writeTree(t, tmp, map[string]string{
+		"go.mod":     "module gpp.com/watch\n\ngo 1.13\n",
+		"lib/lib.go": "package lib\n\nimport \"fmt\"\n\nfunc Print_μ(v interface{}) {\n\tval := 0\n\tfmt.Println(val)\n}\n",
+		"main.go":    src("main", "1"),
+		"a/a.go":     src("a", "2"),
+	})
+	cfg := expand.Config{Dir: tmp, Patterns: []string{"./..."}}
+	files, err := expandDir(cfg, "")
+	if err != nil {
+		t.Fatalf("expand error %+v", err)
+	}
+	mainFile, aFile := filepath.Join(tmp, "main.go"), filepath.Join(tmp, "a", "a.go")
+	unchanged := files[aFile]
+	if files[mainFile] == nil || unchanged == nil {
+		t.Fatalf("expected main.go and a/a.go expanded, got %v", files)
+	}
+	// changed file is expanded again, other packages are kept
+	writeTree(t, tmp, map[string]string{"main.go": src("main", "3")})
+	err = reexpand(tmp, files, []string{"main.go"}, cfg, nil)
+	if err != nil {
+		t.Fatalf("reexpand error %+v", err)
+	}
+	if f := files[mainFile]; f == nil || !strings.Contains(string(f.Src), ":= 3") {
+		t.Errorf("expected main.go expanded with changed arg, got %v", files)
+	}
+	if files[aFile] != unchanged {
+		t.Errorf("expected a/a.go not expanded again")
+	}
+	// files in skipped directories are not expanded
+	out := filepath.Join(tmp, "out")
+	writeTree(t, out, map[string]string{"main.go": src("main", "4")})
+	err = reexpand(tmp, files, []string{"out/main.go"}, cfg, []string{out})
+	if err != nil {
+		t.Fatalf("reexpand error %+v", err)
+	}
+	if _, ok := files[filepath.Join(out, "main.go")]; ok {
+		t.Errorf("expected out/main.go not expanded")
+	}
+	err = os.RemoveAll(out)
+	if err != nil {
+		t.Fatalf("remove error %+v", err)
+	}
+	// importers of changed macro are expanded again
+	writeTree(t, tmp, map[string]string{
+		"lib/lib.go": "package lib\n\nimport \"fmt\"\n\nfunc Print_μ(v interface{}) {\n\tval := 0\n\tfmt.Println(\"changed\", val)\n}\n",
+	})
+	err = reexpand(tmp, files, []string{"lib/lib.go"}, cfg, nil)
+	if err != nil {
+		t.Fatalf("reexpand error %+v", err)
+	}
+	for _, fname := range []string{mainFile, aFile} {
+		if f := files[fname]; f == nil || !strings.Contains(string(f.Src), "\"changed\"") {
+			t.Errorf("expected %s expanded with changed macro, got %v", fname, f)
+		}
+	}
+	// expansion of removed package is dropped
+	err = os.RemoveAll(filepath.Join(tmp, "a"))
+	if err != nil {
+		t.Fatalf("remove error %+v", err)
+	}
+	err = reexpand(tmp, files, []string{"a/a.go"}, cfg, nil)
+	if err != nil {
+		t.Fatalf("reexpand error %+v", err)
+	}
+	if _, ok := files[aFile]; ok || files[mainFile] == nil {
+		t.Errorf("expected a/a.go dropped and main.go kept, got %v", files)
+	}
+}
+
+func TestWriteOverlay(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gpp-test-overlay")
+	if err != nil {
+		t.Fatalf("temp dir error %+v", err)
+	}
+	defer os.RemoveAll(tmp)
+	// files of user in build dir are kept
+	writeTree(t, tmp, map[string]string{"src/keep.go": "package keep\n"})
+	_, err = writeOverlay(tmp, map[string]*expand.File{"/app/a.go": {Src: []byte("package a\n")}})
+	if err != nil {
+		t.Fatalf("write overlay error %+v", err)
+	}
+	overlay, err := writeOverlay(tmp, map[string]*expand.File{"/app/b.go": {Src: []byte("package b\n")}})
+	if err != nil {
+		t.Fatalf("write overlay error %+v", err)
+	}
+	if overlay != filepath.Join(tmp, overlayDirName, "overlay.json") {
+		t.Errorf("unexpected overlay path %s", overlay)
+	}
+	for fname, exists := range map[string]bool{
+		filepath.Join(tmp, "src", "keep.go"): true,
+		overlayFile(tmp, "/app/b.go"):        true,
+		overlayFile(tmp, "/app/a.go"):        false,
+	} {
+		if _, err := os.Stat(fname); (err == nil) != exists {
+			t.Errorf("expected %s exists %v, got error %v", fname, exists, err)
+		}
+	}
+	// overlay directory not written by gpp is not removed
+	other := filepath.Join(tmp, "other")
+	writeTree(t, other, map[string]string{overlayDirName + "/keep.go": "package keep\n"})
+	_, err = writeOverlay(other, nil)
+	expected := errors.New(filepath.Join(other, overlayDirName) + " is not written by gpp, it is not removed")
+	isUnexpectedErr(t, 0, "not marked", expected, err)
+}
+
+func TestCheckBuildDir(t *testing.T) {
+	cases := []struct {
+		desc     string
+		buildDir string
+		out      string
+		err      error
+	}{
+		{desc: "temp", buildDir: "/tmp/gpp/app", out: "/tmp/gpp/app"},
+		{desc: "in module", buildDir: "/src/app/.gpp/build", out: "/src/app/.gpp/build"},
+		{desc: "module root", buildDir: "/src/app", err: errors.New("/src/app contains sources of /src/app")},
+		{desc: "parent", buildDir: "/src/app/..", err: errors.New("/src contains sources of /src/app")},
+		{desc: "replaced module", buildDir: "/src", err: errors.New("/src contains sources of /src/app")},
+	}
+	for i, tc := range cases {
+		out, err := checkBuildDir(tc.buildDir, []string{"/src/app", "/src/lib"})
+		if isUnexpectedErr(t, i, tc.desc, tc.err, err) {
+			continue
+		}
+		if out != tc.out {
+			t.Errorf("case [%d] %s\nexpected %s, got %s", i, tc.desc, tc.out, out)
+		}
+	}
+}
+
+func TestCheckOutDir(t *testing.T) {
+	cases := []struct {
+		desc string
+		out  string
+		err  error
+	}{
+		{desc: "outside", out: "/tmp/out"},
+		{desc: "sibling", out: "/src/app-out"},
+		{desc: "hidden", out: "/src/app/.gpp/out"},
+		{desc: "underscore", out: "/src/app/_out"},
+		{desc: "in hidden", out: "/src/app/.gpp/out/x"},
+		{desc: "source", out: "/src/app", err: errors.New("output directory should differ from source directory")},
+		{desc: "in source", out: "/src/app/out", err: errors.New("output directory /src/app/out is in source directory /src/app, its name should start with . or _")},
+		{desc: "nested", out: "/src/app/cmd/out", err: errors.New("output directory /src/app/cmd/out is in source directory /src/app, its name should start with . or _")},
+	}
+	for i, tc := range cases {
+		err := checkOutDir("/src/app", tc.out)
+		isUnexpectedErr(t, i, tc.desc, tc.err, err)
+	}
+}
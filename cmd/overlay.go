@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mmirolim/gpp/expand"
+)
+
+// overlay is go build -overlay file format
+type overlay struct {
+	Replace map[string]string
+}
+
+// overlayDirName directory of expanded files and overlay in
+// buildDir, only it is removed between builds
+const overlayDirName = ".gpp-overlay"
+
+// overlayMarker file marking overlay directory written by gpp
+const overlayMarker = ".gpp"
+
+// writeOverlay writes expanded files to buildDir under their original
+// absolute paths and overlay file which replaces original files with them,
+// returns overlay file path
+func writeOverlay(buildDir string, files map[string]*expand.File) (string, error) {
+	dir := filepath.Join(buildDir, overlayDirName)
+	// clean previous build, buildDir may be set by config
+	// so only own files are removed
+	err := removeOverlayDir(dir)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, overlayMarker), nil, 0600)
+	if err != nil {
+		return "", err
+	}
+	ov := overlay{Replace: map[string]string{}}
+	for fname, f := range files {
+		dst := overlayFile(buildDir, fname)
+		err = os.MkdirAll(filepath.Dir(dst), 0700)
+		if err != nil {
+			return "", err
+		}
+		err = ioutil.WriteFile(dst, f.Src, 0600)
+		if err != nil {
+			return "", err
+		}
+		ov.Replace[fname] = dst
+	}
+	data, err := json.MarshalIndent(ov, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	overlayPath := filepath.Join(dir, "overlay.json")
+	err = ioutil.WriteFile(overlayPath, data, 0600)
+	return overlayPath, err
+}
+
+// overlayFile returns path of expanded file in buildDir,
+// files of workspace may be outside of working directory
+func overlayFile(buildDir, fname string) string {
+	return filepath.Join(buildDir, overlayDirName, "src", strings.TrimPrefix(fname, filepath.VolumeName(fname)))
+}
+
+// checkBuildDir returns absolute path of buildDir, it should not
+// be or contain source dirs
+func checkBuildDir(buildDir string, srcDirs []string) (string, error) {
+	buildDir, err := filepath.Abs(buildDir)
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range srcDirs {
+		if expand.InDir(dir, buildDir) {
+			return "", fmt.Errorf("%s contains sources of %s", buildDir, dir)
+		}
+	}
+	return buildDir, nil
+}
+
+// removeOverlayDir removes overlay directory of previous build,
+// directory without marker of gpp is not removed
+func removeOverlayDir(dir string) error {
+	_, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(filepath.Join(dir, overlayMarker))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s is not written by gpp, it is not removed", dir)
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
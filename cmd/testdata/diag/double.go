@@ -0,0 +1,7 @@
+package main
+
+import "gpp.com/diag/lib"
+
+func twice() {
+	lib.Double_μ(2)
+}
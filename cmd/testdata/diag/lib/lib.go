@@ -0,0 +1,19 @@
+package lib
+
+import "fmt"
+
+// Show_μ binds only first argument
+func Show_μ(v, w interface{}) {
+	x := v
+	fmt.Println(x, w)
+}
+
+// Double_μ refers to unexported func of lib
+func Double_μ(v interface{}) {
+	x := v
+	fmt.Println(double(x))
+}
+
+func double(v interface{}) interface{} {
+	return v
+}
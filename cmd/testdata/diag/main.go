@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mmirolim/gpp/macro"
+)
+
+type counter struct{ n int }
+
+type state struct{ c counter }
+
+func (c *counter) inc() { c.n++ }
+
+func main() {
+	s := &state{}
+	// not a macro call
+	s.c.inc()
+	f := func() error { return nil }
+	err := macro.Try_μ(f)
+	fmt.Println(s.c.n, err)
+	xs := []int{1, 2}
+	var strs []string
+	macro.NewSeq_μ(xs).Map(func(s string) string { return s }).Ret(&strs)
+	fmt.Println(strs)
+	var keys []string
+	macro.MapKeys_μ(&keys, map[int]string{1: "a"})
+	fmt.Println(keys)
+	if len(keys) > 0 && len(macro.Keys_μ(map[int]int{})) == 0 {
+		fmt.Println("no keys")
+	}
+}
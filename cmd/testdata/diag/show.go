@@ -0,0 +1,7 @@
+package main
+
+import "gpp.com/diag/lib"
+
+func show() {
+	lib.Show_μ(1, 2)
+}
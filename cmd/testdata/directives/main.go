@@ -0,0 +1,28 @@
+//go:build !skip
+// +build !skip
+
+// Package main keeps compiler directives in expanded source
+package main
+
+import (
+	_ "embed"
+	"fmt"
+
+	"github.com/mmirolim/gpp/macro"
+)
+
+//go:generate echo generate
+
+//go:embed msg.txt
+var msg string
+
+func main() {
+	// log of embedded file
+	macro.Log_μ("msg", msg)
+	fmt.Print(msg, twice(2), "\n")
+}
+
+//go:noinline
+func twice(v int) int {
+	return v * len(macro.Keys_μ(map[int]int{v: 1, 2 * v: 2}))
+}
@@ -0,0 +1,17 @@
+package main
+
+import "github.com/mmirolim/gpp/macro"
+
+// package level aliases
+var (
+	info  = macro.Log_μ
+	debug = info
+)
+
+func aliases(n int) {
+	var show = debug
+	func() {
+		info("package alias", n)
+		show("chained alias", n+1)
+	}()
+}
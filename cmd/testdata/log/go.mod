@@ -0,0 +1,13 @@
+module gpp.com/log
+
+go 1.22.0
+
+require github.com/mmirolim/gpp v0.0.0-20200213103918-53695eb9c953
+
+require (
+	golang.org/x/mod v0.23.0 // indirect
+	golang.org/x/sync v0.11.0 // indirect
+	golang.org/x/tools v0.30.0 // indirect
+)
+
+replace github.com/mmirolim/gpp => ../../..
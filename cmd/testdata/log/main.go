@@ -23,6 +23,9 @@ func main() {
 	macro.Log_μ("func calls", sl(10)[0], strr("hello"))
 
 	logger("lib calls", lib.LogLibFuncA(20))
+	macro.Log_μ("value macro", len(macro.Keys_μ(map[int]int{1: 1})))
+	defer macro.Log_μ("deferred", len(a))
+	aliases(1)
 }
 
 func sl(i int) []float64 {
@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Prefix of values printed by macros
+const Prefix = "#"
+
+// Upper_μ appends upper cased strings of in with Prefix to out
+func Upper_μ(out, in interface{}) {
+	res := &[]string{}
+	src := []string{}
+	for _, s := range src {
+		*res = append(*res, Prefix+strings.ToUpper(s))
+	}
+}
+
+type printer_μ struct{}
+
+// Print_μ prints v with Prefix
+func Print_μ(v interface{}) *printer_μ {
+	val := 0
+	fmt.Println(Prefix, val)
+	return nil
+}
+
+// Then prints v after previous print
+func (p *printer_μ) Then(v interface{}) *printer_μ {
+	val := 0
+	fmt.Println(Prefix, val)
+	return nil
+}
+
+// placeholders of types inferred from call args
+type _T interface{}
+type _G interface{}
+
+// Last_μ sets out to last value of in or its zero value
+func Last_μ(out, in interface{}) {
+	res := (*_T)(nil)
+	src := []_T{}
+	var last _T
+	if len(src) > 0 {
+		last = src[len(src)-1]
+	}
+	*res = last
+}
+
+// Zip_μ sets out to map of keys to vals
+func Zip_μ(out, keys, vals interface{}) {
+	res := &map[_T]_G{}
+	ks := []_T{}
+	vs := []_G{}
+	m := make(map[_T]_G, len(ks))
+	for i := range ks {
+		m[ks[i]] = vs[i]
+	}
+	*res = m
+}
+
+// Index_μ returns index of v in in or -1
+func Index_μ(in, v interface{}) int {
+	src := []_T{}
+	val := _T(nil)
+	for i := range src {
+		if src[i] == val {
+			return i
+		}
+	}
+	return -1
+}
+
+// Report_μ prints name and value pointed by p
+func Report_μ(name, p interface{}) {
+	s := ""
+	ptr := (*_T)(nil)
+	v := *ptr
+	fmt.Println(s, v)
+}
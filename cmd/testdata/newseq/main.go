@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/mmirolim/gpp/macro"
+	"gpp.com/newseq/lib"
+)
+
+func main() {
+	fseq := []float64{100, 200, 300, 400, 500, 600}
+	type styp struct{ strLen int }
+	var out []styp
+
+	macro.NewSeq_μ(fseq).Map(func(v float64) float64 { return v + 1 }).
+		Filter(func(v float64) bool { return v < 300 }).
+		Map(ftoa).
+		Map(func(v string, i int) styp { return styp{len(v) + i} }).
+		Ret(&out)
+	fmt.Println("")
+	fmt.Printf("NewSeq Map/Filter %+v\n", out)
+
+	res, totalEvens, totalProduct := lib.Totals([]int{1, 2, 3, 4, 5, 6})
+	fmt.Printf("NewSeq res %d sum even %+v mult even %d\n", res, totalEvens, totalProduct)
+
+	// user vars with names of template vars
+	input := []int{1, 2, 3}
+	var sl []int
+	macro.Map_μ(input, &sl, func(v, i int) int { return v + len(res) })
+	fmt.Printf("Map_μ %v\n", sl)
+	// macros of module packages
+	var words []string
+	lib.Upper_μ(&words, []string{"go", "pp"})
+	fmt.Printf("Upper_μ %v\n", words)
+	var last styp
+	lib.Last_μ(&last, out)
+	var zipped map[string]int
+	lib.Zip_μ(&zipped, words, []int{1, 2})
+	fmt.Printf("Last_μ %+v Zip_μ %v\n", last, zipped)
+	keys := macro.Keys_μ(zipped)
+	sort.Strings(keys)
+	fmt.Println("Keys_μ", keys, len(macro.Vals_μ(zipped)))
+	if i := lib.Index_μ(words, "#PP"); i >= 0 {
+		fmt.Println("Index_μ", i, lib.Index_μ(words, "#C"))
+	}
+	lib.Print_μ("chain").Then(len(words))
+	Twice_μ(len(words))
+	// argument is evaluated at defer statement
+	defer macro.PrintSlice_μ(sl)
+	sl = nil
+	// only arguments are evaluated at defer statement
+	count := 0
+	defer lib.Report_μ("count", &count)
+	count = 5
+}
+
+// Twice_μ prints v twice
+func Twice_μ(v interface{}) {
+	val := 0
+	fmt.Println(val, val)
+}
+
+func ftoa(v float64) string {
+	return strconv.Itoa(int(v))
+}
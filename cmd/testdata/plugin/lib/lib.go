@@ -0,0 +1,7 @@
+package lib
+
+// Square_μ returns square of number, expanded by plugin
+func Square_μ(v interface{}) int { return 0 }
+
+// Hello_μ prints greeting with enclosing func, expanded by plugin
+func Hello_μ(name string) {}
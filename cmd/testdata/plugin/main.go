@@ -0,0 +1,14 @@
+package main
+
+import (
+	"fmt"
+
+	"gpp.com/plugin/lib"
+)
+
+func main() {
+	n := 3
+	fmt.Println("square", lib.Square_μ(n))
+	defer lib.Hello_μ("defer")
+	lib.Hello_μ("gpp")
+}
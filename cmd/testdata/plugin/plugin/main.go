@@ -0,0 +1,36 @@
+// plugin expanding macros of gpp.com/plugin/lib
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mmirolim/gpp/macro"
+)
+
+func main() {
+	var req macro.PluginRequest
+	err := json.NewDecoder(os.Stdin).Decode(&req)
+	if err != nil {
+		log.Fatalf("decode request error %+v", err)
+	}
+	var resp macro.PluginResponse
+	switch req.Macro {
+	case "Square_μ":
+		arg := req.Args[0]
+		resp.Source = fmt.Sprintf("func(v %s) %s { return v * v }(%s)",
+			arg.Type, arg.Type, arg.Source)
+	case "Hello_μ":
+		resp.Source = fmt.Sprintf("msg := strings.ToUpper(%s)\nfmt.Println(%q, msg)",
+			req.Args[0].Source, req.Func)
+		resp.Imports = []string{"fmt", "strings"}
+	default:
+		resp.Error = "unknown macro " + req.Macro
+	}
+	err = json.NewEncoder(os.Stdout).Encode(resp)
+	if err != nil {
+		log.Fatalf("encode response error %+v", err)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	format "fmt"
+
+	mcr "github.com/mmirolim/gpp/macro"
+)
+
+// fmt is imported with other name
+func renamedFmt() error {
+	name := format.Sprint("renamed")
+	return mcr.Try_μ(func() error {
+		fErr(name != "")
+		return nil
+	})
+}
@@ -38,6 +38,24 @@ func main() {
 		return nil
 	})
 	fmt.Printf("(result, err) = (%d, %+v)\n", result, err)
+	// in expressions
+	fmt.Printf("return err = %+v\n", tryReturn())
+	if err := mcr.Try_μ(func() error {
+		fErr(true)
+		return nil
+	}); err != nil {
+		fmt.Printf("if err = %+v\n", err)
+	}
+	fmt.Println("arg err =", mcr.Try_μ(func() error { return nil }))
+	fmt.Printf("renamed err = %+v\n", renamedFmt())
+	fmt.Printf("shadowed err = %+v\n", shadowedFmt())
+}
+
+func tryReturn() error {
+	return mcr.Try_μ(func() error {
+		_, _ = fStrError(true)
+		return nil
+	})
 }
 
 func NoErrReturn() string {
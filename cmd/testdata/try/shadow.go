@@ -0,0 +1,12 @@
+package main
+
+import mcr "github.com/mmirolim/gpp/macro"
+
+// fmt is not imported and shadowed
+func shadowedFmt() error {
+	fmt := "shadowed"
+	return mcr.Try_μ(func() error {
+		fErr(fmt != "")
+		return nil
+	})
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mmirolim/gpp/expand"
+)
+
+// line directives of expanded files, //line maps next line
+// and inline /*line its own line
+var (
+	lineDirectiveRe       = regexp.MustCompile(`^\s*//line (.*?):(\d+)(?::\d+)?\s*$`)
+	inlineLineDirectiveRe = regexp.MustCompile(`/\*line (.*?):(\d+)(?::\d+)?\*/`)
+)
+
+// outputTranslator rewrites paths of expanded files and their lines
+// in go output to original files and lines, output is written by lines
+type outputTranslator struct {
+	w io.Writer
+	// original path by expanded file path
+	files map[string]string
+	// expanded file path by original path
+	expanded map[string]string
+	// line maps of read expanded files
+	lines  map[string][]lineMapping
+	pathRe *regexp.Regexp
+	buf    []byte
+}
+
+// lineMapping maps lines of expanded file starting from line
+// to original file lines starting from origLine
+type lineMapping struct {
+	line     int
+	file     string
+	origLine int
+}
+
+// newOutputTranslator returns writer translating expanded files
+// of overlay to original ones, paths relative to dir are translated too
+func newOutputTranslator(w io.Writer, overlayPath, dir string) (*outputTranslator, error) {
+	data, err := ioutil.ReadFile(overlayPath)
+	if err != nil {
+		return nil, err
+	}
+	var ov overlay
+	err = json.Unmarshal(data, &ov)
+	if err != nil {
+		return nil, err
+	}
+	t := &outputTranslator{
+		w:        w,
+		files:    map[string]string{},
+		expanded: map[string]string{},
+		lines:    map[string][]lineMapping{},
+	}
+	var paths []string
+	for orig, expanded := range ov.Replace {
+		t.files[expanded] = orig
+		t.expanded[orig] = expanded
+		paths = append(paths, regexp.QuoteMeta(expanded))
+		// go prints relative paths of files in its directory
+		if dir != "" && expand.InDir(expanded, dir) {
+			rel, _ := filepath.Rel(dir, expanded)
+			for _, p := range []string{rel, "./" + filepath.ToSlash(rel)} {
+				t.files[p] = orig
+				paths = append(paths, regexp.QuoteMeta(p))
+			}
+		}
+	}
+	if len(paths) > 0 {
+		// longest first to match whole path
+		sort.Slice(paths, func(i, j int) bool { return len(paths[i]) > len(paths[j]) })
+		// whole paths only, not part of other path
+		t.pathRe = regexp.MustCompile(`(?m)(^|[^\w./\\-])(` + strings.Join(paths, "|") + `)(?::(\d+))?`)
+	}
+	return t, nil
+}
+
+// Write writes complete lines translated, rest is buffered until Flush
+func (t *outputTranslator) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	i := bytes.LastIndexByte(t.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	_, err := t.w.Write(t.translate(t.buf[:i+1]))
+	t.buf = append(t.buf[:0], t.buf[i+1:]...)
+	return len(p), err
+}
+
+// Flush writes buffered incomplete line
+func (t *outputTranslator) Flush() error {
+	if len(t.buf) == 0 {
+		return nil
+	}
+	_, err := t.w.Write(t.translate(t.buf))
+	t.buf = t.buf[:0]
+	return err
+}
+
+func (t *outputTranslator) translate(out []byte) []byte {
+	if t.pathRe == nil {
+		return out
+	}
+	return t.pathRe.ReplaceAllFunc(out, func(m []byte) []byte {
+		sub := t.pathRe.FindSubmatch(m)
+		prefix, expanded := string(sub[1]), string(sub[2])
+		if len(sub[3]) == 0 {
+			return []byte(prefix + t.files[expanded])
+		}
+		line, _ := strconv.Atoi(string(sub[3]))
+		file, origLine := t.origLine(expanded, line)
+		return []byte(prefix + file + ":" + strconv.Itoa(origLine))
+	})
+}
+
+// origLine returns original file and line of expanded file line
+// by //line directives in it
+func (t *outputTranslator) origLine(expanded string, line int) (string, int) {
+	orig := t.files[expanded]
+	mappings, ok := t.lines[orig]
+	if !ok {
+		mappings = readLineMappings(t.expanded[orig])
+		t.lines[orig] = mappings
+	}
+	// last mapping before line
+	i := sort.Search(len(mappings), func(i int) bool { return mappings[i].line > line })
+	if i == 0 {
+		return orig, line
+	}
+	m := mappings[i-1]
+	file := m.file
+	if file == "" {
+		file = orig
+	}
+	return file, m.origLine + line - m.line
+}
+
+// readLineMappings parses line directives of expanded file
+func readLineMappings(fname string) []lineMapping {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil
+	}
+	var mappings []lineMapping
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for ln := 1; scanner.Scan(); ln++ {
+		start := ln + 1
+		m := lineDirectiveRe.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			start = ln
+			m = inlineLineDirectiveRe.FindStringSubmatch(scanner.Text())
+		}
+		if m == nil {
+			continue
+		}
+		origLine, _ := strconv.Atoi(m[2])
+		mappings = append(mappings, lineMapping{line: start, file: m[1], origLine: origLine})
+	}
+	return mappings
+}
+
+// flushOutput flushes translated output of finished cmd
+func flushOutput(cmd *exec.Cmd) {
+	for _, w := range []io.Writer{cmd.Stdout, cmd.Stderr} {
+		if t, ok := w.(*outputTranslator); ok {
+			t.Flush()
+		}
+	}
+}
+
+// translateOutput sets cmd output to translators of expanded
+// files in overlay, on error output is left as is
+func translateOutput(cmd *exec.Cmd, overlayPath string) {
+	if overlayPath == "" {
+		return
+	}
+	stdout, err := newOutputTranslator(cmd.Stdout, overlayPath, cmd.Dir)
+	if err != nil {
+		return
+	}
+	stderr, _ := newOutputTranslator(cmd.Stderr, overlayPath, cmd.Dir)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+}
@@ -0,0 +1,270 @@
+package cmd
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mmirolim/gpp/expand"
+	"github.com/mmirolim/gpp/macro"
+)
+
+// pollInterval between source tree scans in watch mode
+const pollInterval = 500 * time.Millisecond
+
+// watch builds sources in cfg.Dir with expanded files overlay and polls
+// source tree of workspace root for changes, on change only packages
+// with changed files are re-expanded, then rebuilt and previous run
+// binary or tests restarted, files in skipDirs like build and expand
+// output directories are not watched
+func watch(root, buildDir string, skipDirs []string, gc *goCommand, files map[string]*expand.File, envs []string, cfg expand.Config) error {
+	modTimes, err := scanTree(root, skipDirs)
+	if err != nil {
+		return err
+	}
+	for {
+		proc := rebuild(cfg.Dir, buildDir, gc, files, envs)
+		for {
+			time.Sleep(pollInterval)
+			newModTimes, err := scanTree(root, skipDirs)
+			if err != nil {
+				// files may be removed while scanning
+				fmt.Fprintf(os.Stderr, "watch scan error %+v\n", err)
+				continue
+			}
+			changed, removed := diffTree(modTimes, newModTimes)
+			if len(changed) == 0 && len(removed) == 0 {
+				continue
+			}
+			modTimes = newModTimes
+			proc.stop()
+			err = reexpand(root, files, append(changed, removed...), cfg, skipDirs)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "watch expand error %+v\n", err)
+				continue
+			}
+			break
+		}
+	}
+}
+
+// rebuild runs go subcommand and starts run binary or tests,
+// returns started process or nil
+func rebuild(dir, buildDir string, gc *goCommand, files map[string]*expand.File, envs []string) *child {
+	overlay, err := writeOverlay(buildDir, files)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "write overlay error %+v\n", err)
+		return nil
+	}
+	cmd := gc.goCmd(dir, overlay, buildDir, envs)
+	if gc.sub == "test" {
+		// tests are run until next change
+		return startChild(cmd)
+	}
+	err = cmd.Run()
+	flushOutput(cmd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "go %s error %+v\n", gc.sub, err)
+		return nil
+	}
+	if gc.sub != "run" {
+		return nil
+	}
+	return startChild(binaryCmd(gc.binary(dir, buildDir), envs, gc.progArgs))
+}
+
+// child process started in watch mode
+type child struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// startChild starts cmd and waits it in background
+func startChild(cmd *exec.Cmd) *child {
+	err := cmd.Start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "exec error %+v\n", err)
+		return nil
+	}
+	c := &child{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		flushOutput(cmd)
+		close(c.done)
+	}()
+	return c
+}
+
+// stop interrupts child process and kills it
+// if it does not exit in time
+func (c *child) stop() {
+	if c == nil {
+		return
+	}
+	select {
+	case <-c.done:
+		return // already exited
+	default:
+	}
+	c.cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-c.done:
+	case <-time.After(3 * time.Second):
+		c.cmd.Process.Kill()
+		<-c.done
+	}
+}
+
+// reexpand expands packages with changed go files in dir
+// and updates their expanded files, files in skipDirs are ignored,
+// importers of changed macros are not known so if changed package
+// declares macros or file is removed all packages are expanded again
+func reexpand(dir string, files map[string]*expand.File, changed []string, cfg expand.Config, skipDirs []string) error {
+	pkgDirs := map[string]bool{}
+	full := false
+	for _, fname := range changed {
+		fname = filepath.Join(dir, fname)
+		if !strings.HasSuffix(fname, ".go") || inDirs(fname, skipDirs) {
+			continue
+		}
+		pkgDirs[filepath.Dir(fname)] = true
+		if _, err := os.Stat(fname); os.IsNotExist(err) {
+			// removed file may declare macros
+			full = true
+		}
+	}
+	for pkgDir := range pkgDirs {
+		if full {
+			break
+		}
+		full = declaresMacros(pkgDir)
+	}
+	if full {
+		expanded, err := expandDir(cfg, "")
+		if err != nil {
+			return err
+		}
+		for fname := range files {
+			delete(files, fname)
+		}
+		for fname, f := range expanded {
+			if !inDirs(fname, skipDirs) {
+				files[fname] = f
+			}
+		}
+		return nil
+	}
+	// drop previous expansion of changed packages
+	for fname := range files {
+		if pkgDirs[filepath.Dir(fname)] {
+			delete(files, fname)
+		}
+	}
+	var patterns []string
+	for pkgDir := range pkgDirs {
+		// skip removed packages
+		goFiles, _ := filepath.Glob(filepath.Join(pkgDir, "*.go"))
+		if len(goFiles) == 0 {
+			continue
+		}
+		rel, err := filepath.Rel(dir, pkgDir)
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, "./"+filepath.ToSlash(rel))
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+	cfg.Dir = dir
+	cfg.Patterns = patterns
+	expanded, err := expandDir(cfg, "")
+	if err != nil {
+		return err
+	}
+	for fname, f := range expanded {
+		// dependencies are not changed
+		if pkgDirs[filepath.Dir(fname)] && !inDirs(fname, skipDirs) {
+			files[fname] = f
+		}
+	}
+	return nil
+}
+
+// declaresMacros reports whether go files in dir declare macros,
+// unparsed files are skipped
+func declaresMacros(dir string) bool {
+	goFiles, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	fset := token.NewFileSet()
+	for _, fname := range goFiles {
+		f, err := parser.ParseFile(fset, fname, nil, parser.SkipObjectResolution)
+		if err != nil {
+			continue
+		}
+		for _, decl := range f.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && macro.IsMacroDecl(fn) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scanTree returns modification times of go sources and module files
+// in dir by relative path, hidden directories and skipDirs are skipped
+func scanTree(dir string, skipDirs []string) (map[string]time.Time, error) {
+	modTimes := map[string]time.Time{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if path != dir && (strings.HasPrefix(name, ".") || inDirs(path, skipDirs)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(name, ".go") && name != "go.mod" && name != "go.sum" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		modTimes[rel] = info.ModTime()
+		return nil
+	})
+	return modTimes, err
+}
+
+// inDirs reports whether path is in any of non empty dirs
+func inDirs(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if dir != "" && expand.InDir(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// diffTree returns changed or new and removed files
+func diffTree(old, cur map[string]time.Time) (changed, removed []string) {
+	for fname, t := range cur {
+		if oldT, ok := old[fname]; !ok || !oldT.Equal(t) {
+			changed = append(changed, fname)
+		}
+	}
+	for fname := range old {
+		if _, ok := cur[fname]; !ok {
+			removed = append(removed, fname)
+		}
+	}
+	return
+}
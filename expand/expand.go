@@ -0,0 +1,563 @@
+// Package expand expands macros of gpp macro library in go packages,
+// original sources are not modified, rewritten files are returned
+package expand
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mmirolim/gpp/macro"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// Config of macro expansion
+type Config struct {
+	// directory to load packages from
+	Dir string
+	// package patterns relative to Dir, "." by default
+	Patterns []string
+	// load and expand test files
+	Tests bool
+	// emit //line directives mapping expanded code to original sources
+	LineDirectives bool
+	// regex matching filename:line of enabled Log_μ calls,
+	// all are enabled if nil
+	LogRe *regexp.Regexp
+	// if set only these macros are expanded,
+	// names may be given without macro symbol
+	Enable []string
+	// macros left as regular function calls
+	Disable []string
+	// directories of sources to expand, by default modules
+	// of workspace of Dir and modules replaced by local paths
+	LocalDirs []string
+}
+
+// File rewritten source of expanded file
+type File struct {
+	Src []byte
+	// lines of expanded macro calls in original source
+	MacroLines map[int]bool
+}
+
+// Diagnostic message at source position
+type Diagnostic struct {
+	Pos      token.Position
+	Severity macro.Severity
+	// stable code of diagnostic kind, CodeLoad
+	// for package load errors or macro.Code*
+	Code    string
+	Message string
+}
+
+// CodeLoad code of package load errors
+const CodeLoad = "load"
+
+// CodePanic code of panics of macro expanders
+const CodePanic = "panic"
+
+// String formats diagnostic as file:line:col: severity[code]: message
+func (d Diagnostic) String() string {
+	msg := fmt.Sprintf("%s[%s]: %s", d.Severity, d.Code, d.Message)
+	if !d.Pos.IsValid() {
+		return msg
+	}
+	return d.Pos.String() + ": " + msg
+}
+
+// MarshalJSON encodes diagnostic with flat position
+func (d Diagnostic) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		File     string         `json:"file,omitempty"`
+		Line     int            `json:"line,omitempty"`
+		Column   int            `json:"column,omitempty"`
+		Severity macro.Severity `json:"severity"`
+		Code     string         `json:"code"`
+		Message  string         `json:"message"`
+	}{d.Pos.Filename, d.Pos.Line, d.Pos.Column, d.Severity, d.Code, d.Message})
+}
+
+// Stats of expansion
+type Stats struct {
+	// loaded packages with dependencies
+	Packages int
+	// rewritten files
+	Files int
+	// expanded macro calls
+	Macros int
+}
+
+// Result of expansion
+type Result struct {
+	// rewritten files by original file path
+	Files       map[string]*File
+	Diagnostics []Diagnostic
+	Stats       Stats
+}
+
+// ErrLoad returned when loaded packages have errors,
+// they are reported as diagnostics
+var ErrLoad = errors.New("packages.Load error")
+
+// ErrExpand returned when macro expansion reports errors,
+// they are reported as diagnostics
+var ErrExpand = errors.New("macro expansion error")
+
+// Expand loads packages matched by patterns, expands macros in them
+// and local packages they import, returns rewritten sources
+func Expand(ctx context.Context, cfg Config) (*Result, error) {
+	patterns := cfg.Patterns
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+	localDirs := cfg.LocalDirs
+	if localDirs == nil {
+		ws, err := LoadWorkspace(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		localDirs = ws.LocalDirs()
+	}
+	pcfg := &packages.Config{
+		Context: ctx,
+		Dir:     cfg.Dir,
+		Mode: packages.NeedName |
+			packages.NeedFiles |
+			packages.NeedCompiledGoFiles |
+			packages.NeedSyntax |
+			packages.NeedTypes |
+			packages.NeedTypesInfo |
+			packages.NeedTypesSizes |
+			packages.NeedImports |
+			packages.NeedDeps,
+		Tests: cfg.Tests,
+	}
+	// find all packages
+	pkgs, err := packages.Load(pcfg, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	res := &Result{Files: map[string]*File{}}
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		res.Diagnostics = append(res.Diagnostics,
+			loadErrors(pkg, packages.ListError, packages.ParseError, packages.UnknownError)...)
+	})
+	if len(res.Diagnostics) > 0 {
+		return res, ErrLoad
+	}
+
+	enabled, disabled := macroNames(cfg.Enable), macroNames(cfg.Disable)
+	// macro func declarations of all packages, only read by workers
+	decls := map[string]*ast.FuncDecl{}
+	// packages declaring macros
+	macroPkgs := map[string]bool{}
+	var jobs []*fileJob
+	var expandedPkgs []*packages.Package
+	// type errors of packages without macros
+	var loadErrs []Diagnostic
+	seen := map[string]bool{}
+	stubbed := map[*ast.File]bool{}
+	// types of loaded packages, test variants excluded
+	loaded := map[string]*types.Package{}
+	// imports are visited before packages importing them
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		res.Stats.Packages++
+		if pkg.ID == pkg.PkgPath {
+			loaded[pkg.PkgPath] = pkg.Types
+		}
+		var declDiags macro.Diagnostics
+		n := len(decls)
+		for _, file := range pkg.Syntax {
+			macro.AllMacroDecl(file, pkg, decls, &declDiags)
+		}
+		res.addDiagnostics(pkg.Fset, declDiags)
+		if len(decls) > n {
+			macroPkgs[pkg.PkgPath] = true
+		}
+		if !usesMacroPkg(pkg, macroPkgs) {
+			loadErrs = append(loadErrs, loadErrors(pkg, packages.TypeError)...)
+			return // no macro in package
+		}
+		// type errors are checked in expanded code, values
+		// of macros have placeholder types before expansion
+		expandedPkgs = append(expandedPkgs, pkg)
+		aliases := macro.PkgAliases(pkg)
+		for i, file := range pkg.Syntax {
+			// skip non local files, sources of workspace modules
+			// and modules replaced by local paths are expanded
+			// TODO check net package have more pkg.Syntax than pkg.GoFiles
+			if i >= len(pkg.GoFiles) {
+				continue
+			}
+			fname := pkg.GoFiles[i]
+			srcDir := localDir(localDirs, fname)
+			// test variants of package have same files
+			if srcDir == "" || seen[fname] {
+				continue
+			}
+			seen[fname] = true
+			if cfg.LogRe != nil && !stubbed[pkg.Syntax[0]] {
+				// insert nooplog stub once per package,
+				// test variants may share parsed files
+				insertNoOpLogStub(pkg.Syntax[0])
+				stubbed[pkg.Syntax[0]] = true
+			}
+			jobs = append(jobs, &fileJob{
+				fname: fname,
+				ctx: &macro.Context{
+					MacroLibName: getMacroLibName(file),
+					RemoveLib:    true,
+					File:         file,
+					Fset:         pkg.Fset,
+					Pkg:          pkg,
+					SrcDir:       srcDir,
+					LogRe:        cfg.LogRe,
+					Enabled:      enabled,
+					Disabled:     disabled,
+					Decls:        decls,
+					Aliases:      aliases,
+				},
+			})
+		}
+	})
+
+	if len(loadErrs) > 0 {
+		res.Diagnostics = append(loadErrs, res.Diagnostics...)
+		return res, ErrLoad
+	}
+
+	// files have own ASTs and are expanded concurrently
+	queue := make(chan *fileJob)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if ctx.Err() != nil {
+					continue
+				}
+				job.expand(cfg.LineDirectives)
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	var expandedJobs []*fileJob
+	for _, job := range jobs {
+		if job.err != nil {
+			return res, fmt.Errorf("format node %s error %+v", job.fname, job.err)
+		}
+		res.addDiagnostics(job.ctx.Fset, job.ctx.Diagnostics)
+		if job.panic != nil {
+			res.Diagnostics = append(res.Diagnostics, *job.panic)
+			continue
+		}
+		res.Files[job.fname] = job.file
+		res.Stats.Files++
+		res.Stats.Macros += len(job.ctx.Expanded)
+		expandedJobs = append(expandedJobs, job)
+	}
+	res.typeCheck(expandedPkgs, expandedJobs, loaded)
+	for _, d := range res.Diagnostics {
+		if d.Severity == macro.Error {
+			return res, ErrExpand
+		}
+	}
+	return res, nil
+}
+
+// typeCheck type checks packages with expanded macros,
+// type errors are added to diagnostics, type errors of load
+// are added for packages not checked
+func (res *Result) typeCheck(pkgs []*packages.Package, jobs []*fileJob, loaded map[string]*types.Package) {
+	byFile := map[string]*fileJob{}
+	for _, job := range jobs {
+		byFile[job.fname] = job
+	}
+	imp := &pkgImporter{loaded: loaded}
+	reported := map[string]bool{}
+	for _, pkg := range pkgs {
+		var files []*ast.File
+		var expanded []macro.Expansion
+		for _, fname := range pkg.GoFiles {
+			job, ok := byFile[fname]
+			if !ok {
+				break
+			}
+			files = append(files, job.ctx.File)
+			expanded = append(expanded, job.ctx.Expanded...)
+		}
+		diags := loadErrors(pkg, packages.TypeError)
+		// cgo files are not expanded
+		cgo := len(pkg.CompiledGoFiles) != len(pkg.GoFiles)
+		if !cgo && len(files) == len(pkg.GoFiles) && len(expanded) > 0 {
+			diags = typeCheck(pkg, files, expanded, imp)
+		}
+		for _, d := range diags {
+			// test variants have same files
+			if !reported[d.String()] {
+				reported[d.String()] = true
+				res.Diagnostics = append(res.Diagnostics, d)
+			}
+		}
+	}
+}
+
+// loadErrors returns errors of pkg of kinds as diagnostics
+func loadErrors(pkg *packages.Package, kinds ...packages.ErrorKind) []Diagnostic {
+	var diags []Diagnostic
+	for _, e := range pkg.Errors {
+		for _, kind := range kinds {
+			if e.Kind == kind {
+				diags = append(diags, Diagnostic{
+					Pos:      parsePos(e.Pos),
+					Severity: macro.Error,
+					Code:     CodeLoad,
+					Message:  e.Msg,
+				})
+			}
+		}
+	}
+	return diags
+}
+
+// addDiagnostics adds macro diagnostics with positions resolved by fset
+func (res *Result) addDiagnostics(fset *token.FileSet, diags macro.Diagnostics) {
+	for _, d := range diags {
+		res.Diagnostics = append(res.Diagnostics, Diagnostic{
+			Pos:      fset.Position(d.Pos),
+			Severity: d.Severity,
+			Code:     d.Code,
+			Message:  d.Message,
+		})
+	}
+}
+
+// fileJob expansion of one file by worker
+type fileJob struct {
+	fname string
+	ctx   *macro.Context
+	file  *File
+	err   error
+	// panic of expander, file is not expanded
+	panic *Diagnostic
+}
+
+// expand expands file of job, panic of expander is reported
+// as error at file
+func (job *fileJob) expand(lineDirectives bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			job.panic = &Diagnostic{
+				Pos:      job.ctx.Fset.Position(job.ctx.File.Package),
+				Severity: macro.Error,
+				Code:     CodePanic,
+				Message:  fmt.Sprintf("expand panic %v", r),
+			}
+		}
+	}()
+	job.file, job.err = expandFile(job.ctx, lineDirectives)
+}
+
+// expandFile expands macros in file of ctx and formats it
+func expandFile(ctx *macro.Context, lineDirectives bool) (*File, error) {
+	used := usedImports(ctx.File, ctx.Pkg)
+	modifiedAST := astutil.Apply(ctx.File, ctx.Pre, ctx.Post)
+	updatedFile := modifiedAST.(*ast.File)
+	// comments of replaced code
+	for _, span := range ctx.Replaced {
+		dropComments(updatedFile, span.Pos, span.End)
+	}
+	removeUnusedImports(ctx, updatedFile, used)
+	astStr, err := macro.FormatFile(ctx.Fset, updatedFile, lineDirectives)
+	if err != nil {
+		return nil, err
+	}
+	macroLines := map[int]bool{}
+	for _, span := range ctx.Expanded {
+		start, end := ctx.Fset.Position(span.Pos), ctx.Fset.Position(span.End)
+		for ln := start.Line; ln <= end.Line; ln++ {
+			macroLines[ln] = true
+		}
+	}
+	return &File{Src: []byte(astStr), MacroLines: macroLines}, nil
+}
+
+// parsePos parses file:line:col position of packages error
+func parsePos(s string) token.Position {
+	var pos token.Position
+	if s == "" || s == "-" {
+		return pos
+	}
+	pos.Filename = s
+	// file may contain colons
+	for i := 0; i < 2; i++ {
+		j := strings.LastIndexByte(pos.Filename, ':')
+		if j < 0 {
+			break
+		}
+		n, err := strconv.Atoi(pos.Filename[j+1:])
+		if err != nil {
+			break
+		}
+		pos.Line, pos.Column = n, pos.Line
+		pos.Filename = pos.Filename[:j]
+	}
+	return pos
+}
+
+func macroNames(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	set := map[string]bool{}
+	for _, name := range names {
+		set[strings.TrimSuffix(name, macro.MacroSymbol)+macro.MacroSymbol] = true
+	}
+	return set
+}
+
+// usesMacroPkg checks if package imports package declaring macros
+// or declares and uses own macros, macro library is not expanded
+func usesMacroPkg(pkg *packages.Package, macroPkgs map[string]bool) bool {
+	for path := range pkg.Imports {
+		if macroPkgs[path] {
+			return true
+		}
+	}
+	return macroPkgs[pkg.PkgPath] && pkg.PkgPath != macro.MacroPkgPath
+}
+
+// usedImports returns imports of file used before expansion
+func usedImports(file *ast.File, pkg *packages.Package) map[*ast.ImportSpec]bool {
+	used := map[*ast.ImportSpec]bool{}
+	for _, spec := range file.Imports {
+		used[spec] = usesImport(file, macro.ImportedName(spec, pkg))
+	}
+	return used
+}
+
+// removeUnusedImports removes imports of file not used after
+// expansion, imports unused in source are left to compiler
+func removeUnusedImports(ctx *macro.Context, file *ast.File, used map[*ast.ImportSpec]bool) {
+	for _, spec := range append([]*ast.ImportSpec(nil), file.Imports...) {
+		name := macro.ImportedName(spec, ctx.Pkg)
+		if name == "_" || name == "." || macro.ImportPath(spec) == "C" {
+			continue
+		}
+		// alias declarations and disabled macros keep library
+		if macro.ImportPath(spec) == macro.MacroPkgPath && !ctx.RemoveLib {
+			continue
+		}
+		if wasUsed, ok := used[spec]; ok && !wasUsed {
+			continue
+		}
+		// calls left on errors still use imports
+		if !usesImport(file, name) {
+			removeImport(file, spec)
+		}
+	}
+}
+
+// removeImport removes import spec and its comments from file
+func removeImport(file *ast.File, spec *ast.ImportSpec) {
+	for i := range file.Imports {
+		if file.Imports[i] == spec {
+			file.Imports = append(file.Imports[:i], file.Imports[i+1:]...)
+			break
+		}
+	}
+	for di, decl := range file.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.IMPORT {
+			continue
+		}
+		for i := range genDecl.Specs {
+			if genDecl.Specs[i] != spec {
+				continue
+			}
+			dropComments(file, spec.Pos(), spec.End())
+			for _, cg := range []*ast.CommentGroup{spec.Doc, spec.Comment} {
+				if cg != nil {
+					dropComments(file, cg.Pos(), cg.End())
+				}
+			}
+			if len(genDecl.Specs) == 1 {
+				// remove import decl
+				file.Decls = append(file.Decls[:di], file.Decls[di+1:]...)
+			} else {
+				genDecl.Specs = append(genDecl.Specs[:i], genDecl.Specs[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// usesImport checks if file has selectors of package imported as name
+func usesImport(file *ast.File, name string) bool {
+	used := false
+	ast.Inspect(file, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			// package names are not resolved by parser
+			if ident, ok := sel.X.(*ast.Ident); ok && ident.Name == name && ident.Obj == nil {
+				used = true
+			}
+		}
+		return !used
+	})
+	return used
+}
+
+// dropComments removes comments in source range [pos, end]
+func dropComments(file *ast.File, pos, end token.Pos) {
+	comments := file.Comments[:0]
+	for _, cg := range file.Comments {
+		if cg.Pos() >= pos && cg.End() <= end {
+			continue
+		}
+		comments = append(comments, cg)
+	}
+	file.Comments = comments
+}
+
+// insertNoOpLogStub declares func muting unmatched Log_μ calls in file
+func insertNoOpLogStub(file *ast.File) {
+	decl := macro.CreateNoOpFuncDecl(macro.LogFuncStubName)
+	file.Decls = append(file.Decls, decl)
+}
+
+// getMacroLibName returns name of macro library in import
+func getMacroLibName(file *ast.File) string {
+	macroLibPath := fmt.Sprintf("\"%s\"", macro.MacroPkgPath)
+	for _, imprt := range file.Imports {
+		if imprt.Path.Value == macroLibPath {
+			if imprt.Name != nil {
+				return imprt.Name.Name
+			}
+			return macro.MacroPkgName
+		}
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+package expand
+
+import (
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"github.com/mmirolim/gpp/macro"
+	"golang.org/x/tools/go/packages"
+)
+
+// CodeType code of type errors in expanded code
+const CodeType = "type"
+
+// pkgImporter imports loaded packages by import path,
+// packages added by expansion are imported from export data
+type pkgImporter struct {
+	imports map[string]*packages.Package
+	loaded  map[string]*types.Package
+	// created on first use
+	fallback types.Importer
+}
+
+func (imp *pkgImporter) Import(path string) (*types.Package, error) {
+	if path == "unsafe" {
+		return types.Unsafe, nil
+	}
+	if pkg, ok := imp.imports[path]; ok && pkg.Types != nil {
+		return pkg.Types, nil
+	}
+	if pkg, ok := imp.loaded[path]; ok {
+		return pkg, nil
+	}
+	if imp.fallback == nil {
+		imp.fallback = importer.Default()
+	}
+	return imp.fallback.Import(path)
+}
+
+// typeCheck type checks package with expanded files,
+// errors inside expanded macro calls are reported at them
+func typeCheck(pkg *packages.Package, files []*ast.File, expanded []macro.Expansion, imp *pkgImporter) []Diagnostic {
+	var diags []Diagnostic
+	imp.imports = pkg.Imports
+	conf := types.Config{
+		Importer: imp,
+		Sizes:    pkg.TypesSizes,
+		Error: func(err error) {
+			terr, ok := err.(types.Error)
+			if !ok {
+				diags = append(diags, Diagnostic{Severity: macro.Error, Code: CodeType, Message: err.Error()})
+				return
+			}
+			diags = append(diags, Diagnostic{
+				Pos:      terr.Fset.Position(terr.Pos),
+				Severity: macro.Error,
+				Code:     CodeType,
+				Message:  macroErrorMessage(terr.Pos, terr.Msg, expanded),
+			})
+		},
+	}
+	// errors are reported by conf.Error
+	conf.Check(pkg.PkgPath, pkg.Fset, files, nil)
+	return diags
+}
+
+// macroErrorMessage prefixes msg of error at pos with macro call
+// and its argument causing it
+func macroErrorMessage(pos token.Pos, msg string, expanded []macro.Expansion) string {
+	for _, exp := range expanded {
+		if pos < exp.Pos || pos >= exp.End {
+			continue
+		}
+		// error in argument
+		for _, call := range exp.Calls {
+			for i, arg := range call.Args {
+				if pos >= arg.Pos && pos < arg.End {
+					return fmt.Sprintf("%s: %s argument %d %s: %s",
+						exp.Name, call.Name, i+1, argText(call.ArgsText[i]), msg)
+				}
+			}
+		}
+		// error in generated code of last call before pos
+		call := exp.Calls[0]
+		for _, c := range exp.Calls {
+			if c.Pos <= pos {
+				call = c
+			}
+		}
+		if len(call.Args) == 1 {
+			return fmt.Sprintf("%s: in %s with argument %s: %s",
+				exp.Name, call.Name, argText(call.ArgsText[0]), msg)
+		}
+		return fmt.Sprintf("%s: in %s: %s", exp.Name, call.Name, msg)
+	}
+	return msg
+}
+
+// argText returns argument text in parentheses
+func argText(s string) string {
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		return s
+	}
+	return "(" + s + ")"
+}
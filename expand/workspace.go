@@ -0,0 +1,188 @@
+package expand
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Module main module of go.mod or module used in go.work
+type Module struct {
+	Path string
+	Dir  string
+}
+
+// Workspace main modules found from directory the way go command
+// does it, go.mod and go.work are parsed by go command itself
+type Workspace struct {
+	// directory of go.work or go.mod
+	Root    string
+	Modules []Module
+	// directories of modules replaced by local paths
+	Replaced []string
+}
+
+// modFile go mod edit -json output
+type modFile struct {
+	Module  struct{ Path string }
+	Replace []modReplace
+}
+
+// workFile go work edit -json output
+type workFile struct {
+	Use     []struct{ DiskPath string }
+	Replace []modReplace
+}
+
+type modReplace struct {
+	Old, New struct{ Path, Version string }
+}
+
+// LoadWorkspace finds go.work or go.mod of dir or its parents,
+// without modules dir is treated as GOPATH package
+func LoadWorkspace(dir string) (*Workspace, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var env struct{ GOMOD, GOWORK, GOPATH string }
+	err = goJSON(dir, &env, "env", "-json", "GOMOD", "GOWORK", "GOPATH")
+	if err != nil {
+		return nil, err
+	}
+	ws := &Workspace{}
+	switch {
+	case env.GOWORK != "" && env.GOWORK != "off":
+		ws.Root = filepath.Dir(env.GOWORK)
+		var work workFile
+		err = goJSON(dir, &work, "work", "edit", "-json", env.GOWORK)
+		if err != nil {
+			return nil, err
+		}
+		for _, use := range work.Use {
+			modDir := use.DiskPath
+			if !filepath.IsAbs(modDir) {
+				modDir = filepath.Join(ws.Root, modDir)
+			}
+			err = ws.addModule(modDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		ws.addReplaced(ws.Root, work.Replace)
+	case env.GOMOD != "" && env.GOMOD != os.DevNull:
+		ws.Root = filepath.Dir(env.GOMOD)
+		err = ws.addModule(ws.Root)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		path := gopathImportPath(env.GOPATH, dir)
+		if path == "" {
+			return nil, fmt.Errorf("go.mod not found and %s is not in src of GOPATH %s", dir, env.GOPATH)
+		}
+		ws.Root = dir
+		ws.Modules = []Module{{Path: path, Dir: dir}}
+	}
+	return ws, nil
+}
+
+// gopathImportPath returns import path of package in dir under
+// src of one of gopath dirs or empty string
+func gopathImportPath(gopath, dir string) string {
+	for _, root := range filepath.SplitList(gopath) {
+		src := filepath.Join(root, "src")
+		if root == "" || !InDir(dir, src) {
+			continue
+		}
+		path, err := filepath.Rel(src, dir)
+		if err == nil && path != "." {
+			return filepath.ToSlash(path)
+		}
+	}
+	return ""
+}
+
+// addModule parses go.mod in modDir and adds it as main module
+func (ws *Workspace) addModule(modDir string) error {
+	var mod modFile
+	err := goJSON(modDir, &mod, "mod", "edit", "-json", filepath.Join(modDir, "go.mod"))
+	if err != nil {
+		return err
+	}
+	ws.Modules = append(ws.Modules, Module{Path: mod.Module.Path, Dir: modDir})
+	ws.addReplaced(modDir, mod.Replace)
+	return nil
+}
+
+// addReplaced adds local directories of replace directives,
+// relative paths are resolved from dir of go.mod or go.work
+func (ws *Workspace) addReplaced(dir string, replaces []modReplace) {
+	for _, r := range replaces {
+		// only local paths have no version
+		if r.New.Version != "" {
+			continue
+		}
+		path := r.New.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			ws.Replaced = append(ws.Replaced, path)
+		}
+	}
+}
+
+// Name returns name of workspace, path of its first module
+func (ws *Workspace) Name() string {
+	return ws.Modules[0].Path
+}
+
+// LocalDirs returns directories with local sources
+// of workspace modules and replaced modules
+func (ws *Workspace) LocalDirs() []string {
+	var dirs []string
+	for _, m := range ws.Modules {
+		dirs = append(dirs, m.Dir)
+	}
+	return append(dirs, ws.Replaced...)
+}
+
+// localDir returns innermost of dirs with file or
+// empty string if file is not local
+func localDir(dirs []string, fname string) string {
+	var found string
+	for _, dir := range dirs {
+		if InDir(fname, dir) && len(dir) > len(found) {
+			found = dir
+		}
+	}
+	return found
+}
+
+// InDir reports whether path is dir or is in it
+func InDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// goJSON runs go command in dir and decodes its json output to v
+func goJSON(dir string, v interface{}, args ...string) error {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("go %s error %+v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+	return json.Unmarshal(stdout.Bytes(), v)
+}
@@ -1,8 +1,13 @@
 module github.com/mmirolim/gpp
 
-go 1.13
+go 1.22.0
 
 require (
-	github.com/kr/pretty v0.2.0
-	golang.org/x/tools v0.0.0-20200213200052-63d1300efe97
+	github.com/BurntSushi/toml v0.3.1
+	golang.org/x/tools v0.30.0
+)
+
+require (
+	golang.org/x/mod v0.23.0 // indirect
+	golang.org/x/sync v0.11.0 // indirect
 )
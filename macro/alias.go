@@ -0,0 +1,138 @@
+package macro
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// Alias var initialized with macro func or other alias
+type Alias struct {
+	// name and package path of aliased macro func
+	Name, Path string
+	// declared name and its declaration, muted when expanded
+	// if var is local and used only in calls, nil otherwise
+	Ident *ast.Ident
+	Decl  ast.Node
+}
+
+// PkgAliases collects aliases of macro funcs declared in package
+// by := assignments and var declarations in any scope
+func PkgAliases(pkg *packages.Package) map[types.Object]*Alias {
+	info := pkg.TypesInfo
+	if info == nil {
+		return nil
+	}
+	aliases := map[types.Object]*Alias{}
+	// aliases of aliases resolved after all are found
+	links := map[types.Object]types.Object{}
+	add := func(decl ast.Node, lhs *ast.Ident, rhs ast.Expr) {
+		obj := info.Defs[lhs]
+		if obj == nil {
+			return
+		}
+		var ident *ast.Ident
+		switch v := astutil.Unparen(rhs).(type) {
+		case *ast.Ident:
+			ident = v
+		case *ast.SelectorExpr:
+			ident = v.Sel
+		default:
+			return
+		}
+		switch used := info.Uses[ident].(type) {
+		case *types.Func:
+			if used.Pkg() != nil && strings.HasSuffix(used.Name(), MacroSymbol) {
+				aliases[obj] = &Alias{Name: used.Name(), Path: used.Pkg().Path(), Ident: lhs, Decl: decl}
+			}
+		case *types.Var:
+			links[obj] = used
+			aliases[obj] = &Alias{Ident: lhs, Decl: decl}
+		}
+	}
+	// idents of called funcs
+	called := map[*ast.Ident]bool{}
+	for _, file := range pkg.Syntax {
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch v := n.(type) {
+			case *ast.AssignStmt:
+				if v.Tok == token.DEFINE && len(v.Lhs) == len(v.Rhs) {
+					for i := range v.Lhs {
+						if lhs, ok := v.Lhs[i].(*ast.Ident); ok {
+							add(v, lhs, v.Rhs[i])
+						}
+					}
+				}
+			case *ast.ValueSpec:
+				if len(v.Names) == len(v.Values) {
+					for i := range v.Names {
+						add(v, v.Names[i], v.Values[i])
+					}
+				}
+			case *ast.CallExpr:
+				if ident, ok := v.Fun.(*ast.Ident); ok {
+					called[ident] = true
+				}
+			}
+			return true
+		})
+	}
+	var resolve func(obj types.Object, depth int) *Alias
+	resolve = func(obj types.Object, depth int) *Alias {
+		alias := aliases[obj]
+		// cycles are not possible in valid code
+		if alias == nil || depth > len(links) {
+			return nil
+		}
+		if alias.Name != "" {
+			return alias
+		}
+		return resolve(links[obj], depth+1)
+	}
+	for obj := range links {
+		if target := resolve(obj, 0); target != nil {
+			aliases[obj].Name, aliases[obj].Path = target.Name, target.Path
+		}
+	}
+	// vars used as values are not muted
+	used := map[types.Object]bool{}
+	for ident, obj := range info.Uses {
+		if !called[ident] {
+			used[obj] = true
+		}
+	}
+	for obj, alias := range aliases {
+		if alias.Name == "" {
+			delete(aliases, obj)
+			continue
+		}
+		// package level vars are valid unused
+		if used[obj] || obj.Parent() == pkg.Types.Scope() {
+			alias.Ident, alias.Decl = nil, nil
+		}
+	}
+	return aliases
+}
+
+// mute replaces declared name of expanded alias with _
+func (alias *Alias) mute() {
+	if alias.Ident == nil || alias.Ident.Name == "_" {
+		return
+	}
+	alias.Ident.Name = "_"
+	stmt, ok := alias.Decl.(*ast.AssignStmt)
+	if !ok {
+		return
+	}
+	// change assign symbol if all muted
+	for _, expr := range stmt.Lhs {
+		if ident, ok := expr.(*ast.Ident); !ok || ident.Name != "_" {
+			return
+		}
+	}
+	stmt.Tok = token.ASSIGN
+}
@@ -5,13 +5,13 @@ import (
 	"fmt"
 	"go/ast"
 	"go/format"
+	"go/parser"
+	"go/printer"
 	"go/token"
 	"go/types"
-	"log"
 	"regexp"
 	"strings"
 
-	"github.com/kr/pretty"
 	"golang.org/x/tools/go/ast/astutil"
 	"golang.org/x/tools/go/packages"
 )
@@ -26,34 +26,109 @@ const (
 	MacroPkgName    = "macro"
 )
 
-// TODO move to context?
-var ApplyState = struct {
+// Context of macro expansion in one file, each file is expanded
+// with own context so files can be expanded concurrently
+type Context struct {
+	// name of macro library in file imports
 	MacroLibName string
-	RemoveLib    bool
-	File         *ast.File
-	Fset         *token.FileSet
-	Pkg          *packages.Package
-	SrcDir       string
-	LogRe        *regexp.Regexp
+	// set if macro library import is not used after expansion
+	RemoveLib bool
+	File      *ast.File
+	Fset      *token.FileSet
+	Pkg       *packages.Package
+	// directory of file module, trimmed from Log_μ positions
+	SrcDir string
+	LogRe  *regexp.Regexp
+	// set while in macro func declaration
 	IsOuterMacro bool
-}{}
+	// if set only these macros are expanded
+	Enabled map[string]bool
+	// macros left as regular function calls
+	Disabled map[string]bool
+	// macro func declarations by name, shared between
+	// contexts and must not be modified
+	Decls map[string]*ast.FuncDecl
+	// aliases of macro funcs in package by var, shared
+	// between contexts of package files
+	Aliases map[types.Object]*Alias
+	// expanded macro calls in File
+	Expanded []Expansion
+	// source ranges of statements replaced by generated code,
+	// comments inside them should be dropped
+	Replaced []Span
+	// reported errors and warnings
+	Diagnostics
+	// depth of nested expansion
+	depth int
+	// node generated by top level expansion
+	generated ast.Node
+	// generated names and last id
+	symbols  map[string]bool
+	gensymID int
+	// nodes being walked from root to current
+	frames []*frame
+}
+
+// Span source range of expanded macro call
+type Span struct {
+	Pos, End token.Pos
+}
+
+// Expansion of macro call statement in source
+type Expansion struct {
+	Span
+	// expanded macro
+	Name string
+	// calls of macro chain, macro itself is first
+	Calls []Call
+}
+
+// Call of macro or method of macro type in chain,
+// generated code of call is positioned at its name
+type Call struct {
+	Name string
+	Pos  token.Pos
+	// source ranges and text of arguments
+	Args     []Span
+	ArgsText []string
+}
+
+// define custom macro expand functions by MacroKey of
+// macro or macro type, other macros are expanded as templates
+var MacroExpanders map[string]MacroExpander
 
-// define custom macro expand functions
-// TODO make settable, prefixed by modulename?
-var MacroExpanders = map[string]MacroExpander{
-	Seq_μTypeSymbol: MacroNewSeq,
-	Try_μSymbol:     MacroTryExpand,
-	Log_μSymbol:     MacroLogExpand,
+func init() {
+	// set in init, expanders refer to it by Context.Pre
+	MacroExpanders = map[string]MacroExpander{
+		MacroKey(MacroPkgPath, Seq_μTypeSymbol): MacroNewSeq,
+		MacroKey(MacroPkgPath, Try_μSymbol):     MacroTryExpand,
+		MacroKey(MacroPkgPath, Log_μSymbol):     MacroLogExpand,
+	}
 }
 
-var MacroDecl = map[string]*ast.FuncDecl{}
+// Register registers expander of macro or macro type name declared
+// in package importPath, it should be called before expansion
+func Register(name, importPath string, expander MacroExpander) error {
+	key := MacroKey(importPath, name)
+	if !strings.HasSuffix(name, MacroSymbol) {
+		return fmt.Errorf("macro %s has no %s suffix", key, MacroSymbol)
+	}
+	if expander == nil {
+		return fmt.Errorf("nil expander of macro %s", key)
+	}
+	if _, ok := MacroExpanders[key]; ok {
+		return fmt.Errorf("expander of macro %s is already registered", key)
+	}
+	MacroExpanders[key] = expander
+	return nil
+}
 
 // MacroExpander expander function type
-type MacroExpander func(cur *astutil.Cursor,
+type MacroExpander func(ctx *Context,
+	cur *astutil.Cursor,
 	parentStmt ast.Stmt,
 	idents []*ast.Ident,
 	callArgs [][]ast.Expr,
-	pre, post astutil.ApplyFunc,
 ) bool
 
 // PrintSlice_μ --
@@ -64,142 +139,162 @@ func PrintSlice_μ(sl interface{}) {
 	}
 }
 
-// AllMacroDecl collects func decl of macros
-func AllMacroDecl(f *ast.File, allMacroDecl map[string]*ast.FuncDecl) {
+// AllMacroDecl collects func decl of macros in file of pkg by
+// MacroKey of package path and func or type_μ.method name,
+// unsupported declarations are reported to diags
+func AllMacroDecl(f *ast.File, pkg *packages.Package, allMacroDecl map[string]*ast.FuncDecl, diags *Diagnostics) {
 	for _, decl := range f.Decls {
 		fnDecl, ok := decl.(*ast.FuncDecl)
 		if !ok {
 			continue
 		}
-		if fnDecl.Recv == nil {
-			if strings.HasSuffix(fnDecl.Name.Name, MacroSymbol) {
-				allMacroDecl[fmt.Sprintf("%s.%s", f.Name, fnDecl.Name.Name)] = fnDecl
-				// load without lib prefix
-				allMacroDecl[fnDecl.Name.Name] = fnDecl
+		name := fnDecl.Name.Name
+		if fnDecl.Recv != nil {
+			// method
+			typeName, ok := recvTypeName(fnDecl)
+			if !ok {
+				if strings.Contains(types.ExprString(fnDecl.Recv.List[0].Type), MacroSymbol) {
+					diags.Warnf(fnDecl.Recv.Pos(), CodeInvalidDecl,
+						"unsupported receiver of method %s, skipped", fnDecl.Name.Name)
+				}
+				continue
 			}
-			continue
-		}
-		typeName := ""
-		// method
-		switch v := fnDecl.Recv.List[0].Type.(type) {
-		case *ast.Ident:
-			typeName = v.Name
-		case *ast.StarExpr:
-			ident, ok := v.X.(*ast.Ident)
-			if ok {
-				typeName = ident.Name
-			} else {
-				log.Fatalf("unexpected ast type %T", v.X)
+			name = fmt.Sprintf("%s.%s", typeName, fnDecl.Name.Name)
+			if !strings.HasSuffix(typeName, MacroSymbol) {
+				continue
 			}
-
-		default:
-			log.Fatalf("[WARN] unhandled method reciver case %T\n", v)
-
-		}
-		if strings.HasSuffix(typeName, MacroSymbol) {
-			allMacroDecl[fmt.Sprintf("%s.%s.%s", f.Name, typeName, fnDecl.Name.Name)] = fnDecl
-			allMacroDecl[fmt.Sprintf("%s.%s", typeName, fnDecl.Name.Name)] = fnDecl
+		} else if !strings.HasSuffix(name, MacroSymbol) {
+			continue
 		}
+		allMacroDecl[MacroKey(pkg.PkgPath, name)] = fnDecl
+		markRefs(fnDecl, pkg)
+		markArgTypes(fnDecl, pkg)
 	}
 }
 
 // Pre ApplyFunc for ast processing
-func Pre(cur *astutil.Cursor) bool {
+func (ctx *Context) Pre(cur *astutil.Cursor) bool {
+	f := newFrame(cur)
+	if !ctx.pre(cur) {
+		return false
+	}
+	if cursorNode(cur) != f.node {
+		// replaced statement is expanded, its old children are skipped
+		return false
+	}
+	ctx.frames = append(ctx.frames, f)
+	return true
+}
+
+func (ctx *Context) pre(cur *astutil.Cursor) bool {
 	n := cur.Node()
 	if funDecl, ok := n.(*ast.FuncDecl); ok {
-		ApplyState.IsOuterMacro = IsMacroDecl(funDecl)
+		ctx.IsOuterMacro = IsMacroDecl(funDecl)
 	}
 	// do not expand in macro func declarations
-	if ApplyState.IsOuterMacro {
+	if ctx.IsOuterMacro {
 		return false
 	}
-	parentStmt, callExpr := getCallExprAndParent(n)
+	// parentStmt is nil for calls in expressions
+	parentStmt, callExpr := getCallExprAndParent(cur)
 	if callExpr == nil {
 		return true
 	}
 	var callArgs [][]ast.Expr
 	var idents []*ast.Ident
-	IdentsFromCallExpr(callExpr, &idents, &callArgs)
-	if len(idents) == 0 {
+	if !IdentsFromCallExpr(callExpr, &idents, &callArgs) || len(idents) == 0 {
 		// skip unhandled cases
 		return true
 	}
 
-	// skip lib prefix
-	if idents[0].Name == ApplyState.MacroLibName {
+	path, qualified := ctx.macroPath(idents[0])
+	if qualified {
+		// skip package prefix
 		idents = idents[1:]
 	}
 
-	if !strings.HasSuffix(idents[0].Name, MacroSymbol) && idents[0].Obj != nil {
-		// resolve if var is in local scope
-		if stmt, ok := idents[0].Obj.Decl.(*ast.AssignStmt); ok {
-			newIdent, newCallArgs := resolveVarInLocalScope(idents[0].Name, stmt)
-			if newIdent != nil {
-				// use var pos for new ident
-				newIdent.NamePos = idents[0].Pos()
-				idents[0] = newIdent
-				if strings.HasSuffix(newIdent.Name, MacroSymbol) {
-					ApplyState.RemoveLib = false
-				}
-			}
-			if newCallArgs != nil {
-				callArgs = append([][]ast.Expr{newCallArgs}, callArgs...)
-			}
+	// alias var of macro func
+	var alias *Alias
+	if !qualified && !strings.HasSuffix(idents[0].Name, MacroSymbol) && ctx.Pkg != nil && ctx.Pkg.TypesInfo != nil {
+		alias = ctx.Aliases[ctx.Pkg.TypesInfo.Uses[idents[0]]]
+		if alias != nil {
+			// use var pos for new ident, alias declaration keeps its own
+			idents[0] = &ast.Ident{Name: alias.Name, NamePos: idents[0].Pos()}
+			path = alias.Path
+			ctx.RemoveLib = false
 		}
 	}
 
-	decl := getMacroDeclByName(idents[0].Name)
+	decl := ctx.Decls[MacroKey(path, idents[0].Name)]
 	if decl == nil {
 		return true
 	}
+	if !ctx.isMacroEnabled(idents[0].Name) {
+		// call macro lib func as is
+		ctx.RemoveLib = false
+		return true
+	}
+	if alias != nil {
+		alias.mute()
+	}
 	macroTypeName := getFirstTypeInReturn(decl)
 	ident := idents[0]
-	ident.Obj = &ast.Object{Name: ident.Name, Decl: decl}
+	ident.Obj = &ast.Object{Kind: ast.Fun, Name: ident.Name, Decl: decl, Data: pkgRef(path)}
+	// expanded statement or call in expression
+	var node ast.Node = callExpr
+	if parentStmt != nil {
+		node = parentStmt
+	}
+	// positions before expansion
+	expansion := newExpansion(node, idents, callArgs)
+	var user map[*ast.Ident]bool
+	if ctx.depth == 0 {
+		user = userIdents(node)
+		ctx.generated = nil
+	}
+	// macros in generated code are not recorded
+	ctx.depth++
+	expanded := false
 	// get expand func
-	if expand, ok := MacroExpanders[macroTypeName]; ok {
-		expand(cur, parentStmt, idents, callArgs, Pre, Post)
-	} else if expand, ok := MacroExpanders[ident.Name]; ok {
-		expand(cur, parentStmt, idents, callArgs, Pre, Post)
+	if expand, ok := MacroExpanders[MacroKey(path, macroTypeName)]; ok {
+		expanded = expand(ctx, cur, parentStmt, idents, callArgs)
+	} else if expand, ok := MacroExpanders[MacroKey(path, ident.Name)]; ok {
+		expanded = expand(ctx, cur, parentStmt, idents, callArgs)
 	} else if strings.HasSuffix(ident.Name, MacroSymbol) {
-		MacroGeneralExpand(cur, parentStmt, idents, callArgs, Pre, Post)
+		expanded = MacroGeneralExpand(ctx, cur, parentStmt, idents, callArgs)
+	}
+	ctx.depth--
+	if expanded && ctx.depth == 0 {
+		ctx.Expanded = append(ctx.Expanded, expansion)
+		// node is changed in place if not replaced
+		generated := ctx.generated
+		if generated == nil {
+			generated = node
+		}
+		ctx.hygiene(generated, user)
 	}
-	return true
+	// replaced call is expanded, its old children are skipped
+	return parentStmt != nil || !expanded
 
 }
 
-func resolveVarInLocalScope(identName string, stmt *ast.AssignStmt) (ident *ast.Ident, args []ast.Expr) {
-	id := 0
-	numberOfMuted := 0
-	for i, expr := range stmt.Lhs {
-		if lhsIdent, ok := expr.(*ast.Ident); ok {
-			// original ident name
-			if lhsIdent.Obj.Name == identName {
-				id = i
-			}
-			if lhsIdent.Name == "_" {
-				numberOfMuted++
+// newExpansion records calls of macro chain with their arguments
+func newExpansion(node ast.Node, idents []*ast.Ident, callArgs [][]ast.Expr) Expansion {
+	exp := Expansion{
+		Span: Span{Pos: node.Pos(), End: node.End()},
+		Name: idents[0].Name,
+	}
+	for i := range idents {
+		call := Call{Name: idents[i].Name, Pos: idents[i].Pos()}
+		if i < len(callArgs) {
+			for _, arg := range callArgs[i] {
+				call.Args = append(call.Args, Span{Pos: arg.Pos(), End: arg.End()})
+				call.ArgsText = append(call.ArgsText, types.ExprString(arg))
 			}
 		}
+		exp.Calls = append(exp.Calls, call)
 	}
-	switch expr := stmt.Rhs[id].(type) {
-	case *ast.SelectorExpr:
-		ident = expr.Sel
-	case *ast.Ident:
-		ident = expr
-	default:
-		// unhandled
-	}
-
-	if ident != nil {
-		if muteIdent, ok := stmt.Lhs[id].(*ast.Ident); ok {
-			muteIdent.Name = "_"
-		}
-		// change assign symbol if all muted
-		if numberOfMuted+1 == len(stmt.Lhs) {
-			stmt.Tok = token.ASSIGN
-		}
-	}
-	return
+	return exp
 }
 
 func getFirstTypeInReturn(decl ast.Decl) string {
@@ -212,72 +307,116 @@ func getFirstTypeInReturn(decl ast.Decl) string {
 			expr, ok := fnDecl.Type.Results.List[0].Type.(*ast.StarExpr)
 			if ok {
 				//  TODO use recursive solution
-				id := expr.X.(*ast.Ident)
-				return id.Name
+				if id, ok := expr.X.(*ast.Ident); ok {
+					return id.Name
+				}
 			}
 		}
 	}
 	return ""
 }
 
-func getCallExprAndParent(n ast.Node) (parentStmt ast.Stmt, callExpr *ast.CallExpr) {
-	switch stmt := n.(type) {
-	case *ast.ExprStmt:
-		// as standalone expr
-		if cexp, ok := stmt.X.(*ast.CallExpr); ok {
-			parentStmt = stmt
-			callExpr = cexp
+// getCallExprAndParent returns call of expression, go or defer
+// statement with the statement and any other call in expression
+// without statement, calls of statements are found at statements
+// and calls of chain at last call
+func getCallExprAndParent(cur *astutil.Cursor) (parentStmt ast.Stmt, callExpr *ast.CallExpr) {
+	switch n := cur.Node().(type) {
+	case *ast.ExprStmt, *ast.GoStmt, *ast.DeferStmt:
+		if call := stmtCall(n); call != nil {
+			return n.(ast.Stmt), call
 		}
-	case *ast.AssignStmt:
-		// in assignment
-		for i := range stmt.Rhs {
-			if cexp, ok := stmt.Rhs[i].(*ast.CallExpr); ok {
-				parentStmt = stmt
-				callExpr = cexp
-			}
+	case *ast.CallExpr:
+		// calls of chain are expanded with last call
+		if _, ok := cur.Parent().(*ast.SelectorExpr); ok {
+			return nil, nil
+		}
+		if stmtCall(cur.Parent()) != n {
+			return nil, n
 		}
 	}
-	return
+	return nil, nil
 }
 
-func getMacroDeclByName(name string) *ast.FuncDecl {
-	if fdecl, ok := MacroDecl[name]; ok {
-		return fdecl
+// stmtCall returns call of expression, go or defer statement
+func stmtCall(n ast.Node) *ast.CallExpr {
+	switch stmt := n.(type) {
+	case *ast.ExprStmt:
+		call, _ := stmt.X.(*ast.CallExpr)
+		return call
+	case *ast.GoStmt:
+		return stmt.Call
+	case *ast.DeferStmt:
+		return stmt.Call
 	}
 	return nil
 }
 
-// Post ApplyFunc for ast processing
-func Post(cur *astutil.Cursor) bool {
+// isMacroEnabled checks enabled and disabled macros by name
+func (ctx *Context) isMacroEnabled(name string) bool {
+	if ctx.Enabled != nil && !ctx.Enabled[name] {
+		return false
+	}
+	return !ctx.Disabled[name]
+}
+
+// Post ApplyFunc for ast processing, inserts statements
+// hoisted from expressions of statement before it
+func (ctx *Context) Post(cur *astutil.Cursor) bool {
+	f := ctx.frames[len(ctx.frames)-1]
+	ctx.frames = ctx.frames[:len(ctx.frames)-1]
+	for _, stmt := range f.hoisted {
+		cur.InsertBefore(stmt)
+	}
 	return true
 }
 
 // MacroGeneralExpand default expander
 // TODO describe rules
 func MacroGeneralExpand(
+	ctx *Context,
 	cur *astutil.Cursor,
 	parentStmt ast.Stmt,
 	idents []*ast.Ident,
-	callArgs [][]ast.Expr,
-	pre, post astutil.ApplyFunc) bool {
+	callArgs [][]ast.Expr) bool {
+	if parentStmt == nil {
+		if decl, ok := idents[0].Obj.Decl.(*ast.FuncDecl); ok && isValueMacro(decl) {
+			return expandValue(ctx, cur, idents, callArgs)
+		}
+		ctx.Errorf(idents[0].Pos(), CodeInvalidCall, "%s can not be used in expression", idents[0].Name)
+		return false
+	}
 	var newSeqBlocks []ast.Stmt
 	var blocks []ast.Stmt
-
+	path, _ := refPath(idents[0])
+	// macro type returned by previous call of chain
+	var recvType string
 	for i := 0; i < len(idents); i++ {
 		ident := idents[i]
-		if !strings.HasSuffix(ident.Name, MacroSymbol) {
-			continue
-		}
-		// check if ident has return type
 		var funDecl *ast.FuncDecl
-		var ok bool
-		// TODO handle other types, use Seq resolver
-		if funDecl, ok = ident.Obj.Decl.(*ast.FuncDecl); !ok {
-			fmt.Printf("WARN MacroGeneralExpand funDecl expected but got %+v\n", ident.Obj.Decl)
+		if i == 0 {
+			var ok bool
+			if funDecl, ok = ident.Obj.Decl.(*ast.FuncDecl); !ok {
+				ctx.Errorf(ident.Pos(), CodeInvalidCall, "%s is not a macro func", ident.Name)
+				return false
+			}
+		} else if recvType != "" {
+			// method of macro type
+			name := fmt.Sprintf("%s.%s", recvType, ident.Name)
+			funDecl = ctx.Decls[MacroKey(path, name)]
+			if funDecl == nil {
+				ctx.Errorf(ident.Pos(), CodeUnknownMethod, "unknown method %s", name)
+				return false
+			}
+		} else {
 			continue
 		}
+		recvType = getFirstTypeInReturn(funDecl)
+		if !strings.HasSuffix(recvType, MacroSymbol) {
+			recvType = ""
+		}
 		body := copyBodyStmt(len(callArgs[i]),
-			funDecl.Body, true)
+			funDecl.Body, true, cur.Node().Pos())
 		// find all body args defined as assignments
 		var bodyArgs []*ast.AssignStmt
 		for _, ln := range body.List {
@@ -285,33 +424,116 @@ func MacroGeneralExpand(
 				bodyArgs = append(bodyArgs, st)
 			}
 		}
-
-		// TODO check that number of args is correct
+		if len(bodyArgs) < len(callArgs[i]) {
+			ctx.Errorf(ident.Pos(), CodeInvalidArg, "%s expects %d arguments", ident.Name, len(bodyArgs))
+			return false
+		}
 		// switch Rhs with call args
 		for i, carg := range callArgs[i] {
-			bodyArgs[i].Rhs = []ast.Expr{carg}
+			setArgRhs(bodyArgs[i], carg)
+		}
+		if !ctx.substTypeParams(ident, body, bodyArgs, callArgs[i]) {
+			return false
+		}
+		if !ctx.resolveTemplateRefs(ident, body, callArgs[i], cur.Node().Pos()) {
+			return false
 		}
 		// expand body macros
-		astutil.Apply(body, pre, post)
+		astutil.Apply(body, ctx.Pre, ctx.Post)
 		blocks = append(blocks, body)
 
 	}
 	if len(blocks) > 0 {
 		blockStmt := new(ast.BlockStmt)
-		blockStmt.Lbrace = cur.Node().End()
+		blockStmt.Lbrace = cur.Node().Pos()
+		blockStmt.Rbrace = cur.Node().End()
 		if newSeqBlocks != nil {
 			blockStmt.List = append(blockStmt.List, newSeqBlocks...)
 			newSeqBlocks = nil
 		}
 		blockStmt.List = append(blockStmt.List, blocks...)
+		// map generated code to call site
+		fillPos(blockStmt, cur.Node().Pos())
 		// insert as one block
-		cur.InsertAfter(blockStmt)
-		cur.Delete()
+		replaceStmt(ctx, cur, blockStmt, len(callArgs[0]))
 	}
 
 	return true
 }
 
+// replaceStmt replaces current statement with generated stmt
+// and records replaced source range, generated block replacing
+// go or defer statement is run by it, args number of leading
+// assignments binding call arguments
+func replaceStmt(ctx *Context, cur *astutil.Cursor, stmt ast.Stmt, args int) {
+	if block, ok := stmt.(*ast.BlockStmt); ok {
+		switch cur.Node().(type) {
+		case *ast.GoStmt, *ast.DeferStmt:
+			stmt = goDeferBlock(cur.Node().(ast.Stmt), block, args)
+		}
+	}
+	if ctx.depth == 1 {
+		ctx.generated = stmt
+	}
+	ctx.Replaced = append(ctx.Replaced,
+		Span{Pos: cur.Node().Pos(), End: cur.Node().End()})
+	cur.InsertAfter(stmt)
+	cur.Delete()
+}
+
+// goDeferBlock wraps generated block in func literal run by go
+// or defer statement s, first args assignments binding macro
+// arguments and statements hoisted before them are kept in place
+// to evaluate arguments as go does
+func goDeferBlock(s ast.Stmt, block *ast.BlockStmt, args int) *ast.BlockStmt {
+	// body of single macro
+	for len(block.List) == 1 {
+		inner, ok := block.List[0].(*ast.BlockStmt)
+		if !ok {
+			break
+		}
+		block = inner
+	}
+	// statements up to last argument binding
+	i := 0
+	for j, bound := 0, 0; j < len(block.List) && bound < args; j++ {
+		if assign, ok := block.List[j].(*ast.AssignStmt); ok && assign.Tok == token.DEFINE {
+			if bound++; bound == args {
+				i = j + 1
+			}
+		}
+	}
+	call := createCallExpr(&ast.FuncLit{
+		Type: &ast.FuncType{Params: &ast.FieldList{}},
+		Body: &ast.BlockStmt{List: block.List[i:]},
+	}, nil)
+	var run ast.Stmt = &ast.DeferStmt{Call: call}
+	if _, ok := s.(*ast.GoStmt); ok {
+		run = &ast.GoStmt{Call: call}
+	}
+	fillPos(run, s.Pos())
+	list := append(block.List[:i:i], run)
+	return &ast.BlockStmt{Lbrace: s.Pos(), List: list, Rbrace: s.End()}
+}
+
+// replaceCall replaces macro call of statement or call in expression
+// by generated call
+func replaceCall(ctx *Context, cur *astutil.Cursor, parentStmt ast.Stmt, call *ast.CallExpr) {
+	switch stmt := parentStmt.(type) {
+	case *ast.ExprStmt:
+		stmt.X = call
+	case *ast.GoStmt:
+		stmt.Call = call
+	case *ast.DeferStmt:
+		stmt.Call = call
+	default:
+		cur.Replace(call)
+		if ctx.depth == 1 {
+			ctx.generated = call
+		}
+	}
+}
+
 func createCallExpr(fun ast.Expr, args []ast.Expr) *ast.CallExpr {
 	expr := &ast.CallExpr{
 		Fun:  fun,
@@ -343,9 +565,10 @@ func createAssignStmt(lhs, rhs []ast.Expr, tok token.Token) *ast.AssignStmt {
 	return stmt
 }
 
-// copyBodyStmt only creates assignment statements
-// shallow copy with new assignable statements
-func copyBodyStmt(argNum int, body *ast.BlockStmt, noreturns bool) *ast.BlockStmt {
+// copyBodyStmt deep copies body with positions set to pos
+// of call site, args assignment statements get empty Rhs
+func copyBodyStmt(argNum int, body *ast.BlockStmt, noreturns bool, pos token.Pos) *ast.BlockStmt {
+	body = cloneNode(body, pos).(*ast.BlockStmt)
 	block := new(ast.BlockStmt)
 	block.Lbrace = body.Lbrace
 	block.Rbrace = body.Rbrace
@@ -362,7 +585,7 @@ func copyBodyStmt(argNum int, body *ast.BlockStmt, noreturns bool) *ast.BlockStm
 		return block
 	}
 
-	for i := 0; i < argNum; i++ {
+	for i := 0; i < argNum && i < len(block.List); i++ {
 		st := block.List[i]
 		// it should be first elements in the list
 		if assignStmt, ok := st.(*ast.AssignStmt); ok {
@@ -378,6 +601,22 @@ func copyBodyStmt(argNum int, body *ast.BlockStmt, noreturns bool) *ast.BlockStm
 	return block
 }
 
+// setArgRhs sets call argument as Rhs of template argument
+// assignment, assignment gets position of argument
+func setArgRhs(stmt *ast.AssignStmt, arg ast.Expr) {
+	stmt.Rhs = []ast.Expr{arg}
+	pos := arg.Pos()
+	if !pos.IsValid() {
+		return
+	}
+	stmt.TokPos = pos
+	for _, expr := range stmt.Lhs {
+		if ident, ok := expr.(*ast.Ident); ok {
+			ident.NamePos = pos
+		}
+	}
+}
+
 // creates var {name} {typ};
 // returns identifier created
 func createDeclStmt(decTyp token.Token, name string, typ ast.Expr) (*ast.DeclStmt, *ast.Ident) {
@@ -400,8 +639,10 @@ func createDeclStmt(decTyp token.Token, name string, typ ast.Expr) (*ast.DeclStm
 	return stmt, ident
 }
 
-// IdentsFromCallExpr
-func IdentsFromCallExpr(expr *ast.CallExpr, idents *[]*ast.Ident, callArgs *[][]ast.Expr) {
+// IdentsFromCallExpr collects idents and args of call chain,
+// returns false for calls which can not be macro calls
+// like calls of indexed, converted or nested selector exprs
+func IdentsFromCallExpr(expr *ast.CallExpr, idents *[]*ast.Ident, callArgs *[][]ast.Expr) bool {
 	switch v := expr.Fun.(type) {
 	case *ast.Ident:
 		*idents = append(*idents, v)
@@ -410,30 +651,30 @@ func IdentsFromCallExpr(expr *ast.CallExpr, idents *[]*ast.Ident, callArgs *[][]
 		case *ast.Ident:
 			*idents = append(*idents, X)
 		case *ast.CallExpr:
-			IdentsFromCallExpr(X, idents, callArgs)
+			if !IdentsFromCallExpr(X, idents, callArgs) {
+				return false
+			}
 		default:
-			log.Fatalf("selector unsupported type %T %# v\n", v, pretty.Formatter(v))
+			return false
 		}
 		*idents = append(*idents, v.Sel)
-	case *ast.IndexExpr:
-		idents = nil
-		return // does not support macro from index expr
 	case *ast.FuncLit:
 		// skip
 	default:
 		// TODO indirections
-		fmt.Printf("WARN IdentsFromCallExpr unsuported type %T\n", v) // output for debug
-		return
+		return false
 	}
 	*callArgs = append(*callArgs, expr.Args)
+	return true
 }
 
 func objKindToTokenType(typ token.Token) ast.ObjKind {
 	switch typ {
 	case token.VAR:
 		return ast.Var
+	case token.CONST:
+		return ast.Con
 	default:
-		log.Fatalf("unexpected type %+v", typ)
 		return ast.Bad
 	}
 }
@@ -446,23 +687,21 @@ func IsMacroDecl(decl *ast.FuncDecl) bool {
 		return strings.HasSuffix(decl.Name.Name, MacroSymbol)
 	}
 	// method
-	fld := decl.Recv.List[0]
-	typeName := ""
-	switch v := fld.Type.(type) {
+	typeName, _ := recvTypeName(decl)
+	return strings.HasSuffix(typeName, MacroSymbol)
+}
+
+// recvTypeName returns type name of method receiver T or *T
+func recvTypeName(decl *ast.FuncDecl) (string, bool) {
+	switch v := decl.Recv.List[0].Type.(type) {
 	case *ast.Ident:
-		typeName = v.Name
+		return v.Name, true
 	case *ast.StarExpr:
-		ident, ok := v.X.(*ast.Ident)
-		if ok {
-			typeName = ident.Name
-		} else {
-			log.Fatalf("unexpected ast type %T", v.X)
+		if ident, ok := v.X.(*ast.Ident); ok {
+			return ident.Name, true
 		}
-	default:
-		fmt.Printf("[WARN] unhandled method reciver case %T\n", v)
 	}
-
-	return strings.HasSuffix(typeName, MacroSymbol)
+	return "", false
 }
 
 func checkIsMacroIdent(name string, idents []*ast.Ident) bool {
@@ -482,13 +721,25 @@ func checkIsMacroIdent(name string, idents []*ast.Ident) bool {
 func FormatNode(node ast.Node) (string, error) {
 	buf := new(bytes.Buffer)
 	err := format.Node(buf, token.NewFileSet(), node)
-	if err != nil {
-		fmt.Printf("AST on error %+v\n", pretty.Formatter(node)) // output for debug
+	return buf.String(), err
+}
+
+// FormatFile format file to text keeping original layout by fset
+// positions, with lineDirectives //line comments are emitted
+// where output lines differ from original source positions
+// so compiler errors and stack traces point to original files
+func FormatFile(fset *token.FileSet, file *ast.File, lineDirectives bool) (string, error) {
+	cfg := printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+	if lineDirectives {
+		cfg.Mode = printer.RawFormat | printer.SourcePos
 	}
+	buf := new(bytes.Buffer)
+	err := cfg.Fprint(buf, fset, file)
 	return buf.String(), err
 }
 
-// resolveExpr create obj with func declaration from expr signature
+// resolveExpr create obj with func declaration from expr signature,
+// returns nil if expr is not a func
 // TODO rename
 func resolveExpr(expr ast.Expr, curPkg *packages.Package) *ast.Object {
 	if sig, ok := curPkg.TypesInfo.TypeOf(expr).(*types.Signature); ok {
@@ -499,11 +750,18 @@ func resolveExpr(expr ast.Expr, curPkg *packages.Package) *ast.Object {
 			},
 		}
 	}
-	fmt.Printf("WARN resolveExpr unhandled expr to resolve %# v\n", pretty.Formatter(expr))
-	fmt.Printf("WARN TypeOf(expr) %#v\n", pretty.Formatter(curPkg.TypesInfo.TypeOf(expr)))
 	return nil
 }
 
+// typeExpr parses type expression without positions
+func typeExpr(typ string) ast.Expr {
+	expr, err := parser.ParseExpr(typ)
+	if err != nil {
+		return &ast.Ident{Name: typ}
+	}
+	return cloneNode(expr, token.NoPos).(ast.Expr)
+}
+
 func createFuncTypeFromSignature(sig *types.Signature, curPkg *packages.Package) *ast.FuncType {
 	ft := &ast.FuncType{}
 	params := sig.Params()
@@ -532,9 +790,7 @@ func createFuncTypeFromSignature(sig *types.Signature, curPkg *packages.Package)
 			Names: []*ast.Ident{
 				{Name: fmt.Sprintf("a%d", i)}, // ignored
 			},
-			Type: &ast.Ident{
-				Name: getVarTyp(params.At(i)),
-			},
+			Type: typeExpr(getVarTyp(params.At(i))),
 		})
 	}
 	results := sig.Results()
@@ -544,9 +800,7 @@ func createFuncTypeFromSignature(sig *types.Signature, curPkg *packages.Package)
 			Names: []*ast.Ident{
 				{Name: fmt.Sprintf("r%d", i)}, // ignored
 			},
-			Type: &ast.Ident{
-				Name: getVarTyp(results.At(i)),
-			},
+			Type: typeExpr(getVarTyp(results.At(i))),
 		})
 	}
 	ft.Params = &ast.FieldList{List: paramList}
@@ -0,0 +1,66 @@
+package macro
+
+import (
+	"fmt"
+	"go/token"
+)
+
+// Severity of diagnostic
+type Severity string
+
+const (
+	// Error macro call is not expanded, expansion fails
+	Error Severity = "error"
+	// Warning macro call is expanded or left as is
+	Warning Severity = "warning"
+)
+
+// stable codes of diagnostics
+const (
+	// unsupported macro declaration in macro library
+	CodeInvalidDecl = "invalid-decl"
+	// macro called in unsupported form
+	CodeInvalidCall = "invalid-call"
+	// unsupported macro call argument
+	CodeInvalidArg = "invalid-arg"
+	// method of macro type not found
+	CodeUnknownMethod = "unknown-method"
+	// call result not checked by Try_μ
+	CodeUncheckedCall = "unchecked-call"
+	// expression can not be formatted
+	CodeFormat = "format"
+	// plugin failed or returned invalid source
+	CodePlugin = "plugin"
+	// type of template placeholder not inferred
+	CodeTypeParam = "type-param"
+)
+
+// Diagnostic reported by macro expansion at source position
+type Diagnostic struct {
+	Pos      token.Pos
+	Severity Severity
+	Code     string
+	Message  string
+}
+
+// Diagnostics collects diagnostics of expansion
+type Diagnostics []Diagnostic
+
+// Errorf reports error at pos
+func (d *Diagnostics) Errorf(pos token.Pos, code, format string, args ...interface{}) {
+	d.report(pos, Error, code, format, args...)
+}
+
+// Warnf reports warning at pos
+func (d *Diagnostics) Warnf(pos token.Pos, code, format string, args ...interface{}) {
+	d.report(pos, Warning, code, format, args...)
+}
+
+func (d *Diagnostics) report(pos token.Pos, severity Severity, code, format string, args ...interface{}) {
+	*d = append(*d, Diagnostic{
+		Pos:      pos,
+		Severity: severity,
+		Code:     code,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
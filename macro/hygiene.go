@@ -0,0 +1,131 @@
+package macro
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// userIdents collects identifiers of macro call statement or call
+// before expansion, they are user code and keep their names
+func userIdents(node ast.Node) map[*ast.Ident]bool {
+	idents := map[*ast.Ident]bool{}
+	ast.Inspect(node, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok {
+			idents[ident] = true
+		}
+		return true
+	})
+	return idents
+}
+
+// hygiene renames identifiers declared by generated code in node
+// and their uses to names not visible at their positions, so
+// expansion does not capture or shadow user variables
+func (ctx *Context) hygiene(node ast.Node, user map[*ast.Ident]bool) {
+	// positions of declarations by name in order of declaration
+	declared := map[string][]token.Pos{}
+	var order []string
+	declare := func(ident *ast.Ident) {
+		if ident == nil || ident.Name == "_" || user[ident] {
+			return
+		}
+		if _, ok := declared[ident.Name]; !ok {
+			order = append(order, ident.Name)
+		}
+		declared[ident.Name] = append(declared[ident.Name], ident.Pos())
+	}
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.AssignStmt:
+			if v.Tok == token.DEFINE {
+				for _, expr := range v.Lhs {
+					if ident, ok := expr.(*ast.Ident); ok {
+						declare(ident)
+					}
+				}
+			}
+		case *ast.RangeStmt:
+			if v.Tok == token.DEFINE {
+				for _, expr := range []ast.Expr{v.Key, v.Value} {
+					if ident, ok := expr.(*ast.Ident); ok {
+						declare(ident)
+					}
+				}
+			}
+		case *ast.ValueSpec:
+			for _, ident := range v.Names {
+				declare(ident)
+			}
+		case *ast.FuncType:
+			for _, fl := range []*ast.FieldList{v.Params, v.Results} {
+				if fl == nil {
+					continue
+				}
+				for _, field := range fl.List {
+					for _, ident := range field.Names {
+						declare(ident)
+					}
+				}
+			}
+		}
+		return true
+	})
+	if len(order) == 0 {
+		return
+	}
+	names := map[string]string{}
+	for _, name := range order {
+		names[name] = ctx.gensym(name, declared[name])
+	}
+	var rename func(n ast.Node) bool
+	rename = func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.SelectorExpr:
+			// field and method names are not renamed
+			ast.Inspect(v.X, rename)
+			return false
+		case *ast.Ident:
+			if name, ok := names[v.Name]; ok && !user[v] {
+				v.Name = name
+			}
+		}
+		return true
+	}
+	ast.Inspect(node, rename)
+}
+
+// gensym returns unique name in file with prefix name
+// not declared in scopes of positions
+func (ctx *Context) gensym(name string, positions []token.Pos) string {
+	if ctx.symbols == nil {
+		ctx.symbols = map[string]bool{}
+	}
+	for {
+		ctx.gensymID++
+		sym := fmt.Sprintf("%s_%d", name, ctx.gensymID)
+		if !ctx.symbols[sym] && !ctx.isVisible(sym, positions) {
+			ctx.symbols[sym] = true
+			return sym
+		}
+	}
+}
+
+// isVisible checks if name is declared in scope of any of positions
+func (ctx *Context) isVisible(name string, positions []token.Pos) bool {
+	if ctx.Pkg == nil || ctx.Pkg.Types == nil {
+		return false
+	}
+	pkgScope := ctx.Pkg.Types.Scope()
+	for _, pos := range positions {
+		scope := pkgScope.Innermost(pos)
+		if scope == nil {
+			scope = pkgScope
+		}
+		if _, obj := scope.LookupParent(name, pos); obj != nil {
+			return true
+		}
+	}
+	return pkgScope.Lookup(name) != nil || types.Universe.Lookup(name) != nil
+}
@@ -0,0 +1,113 @@
+package macro
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// ImportName returns name referring package path at pos in file,
+// existing import is used if it is not shadowed at pos, otherwise
+// import is added with name not conflicting with visible names
+func (ctx *Context) ImportName(path string, pos token.Pos) string {
+	for _, spec := range ctx.File.Imports {
+		if ImportPath(spec) != path {
+			continue
+		}
+		name := ImportedName(spec, ctx.Pkg)
+		if name == "_" || name == "." {
+			continue
+		}
+		if ctx.refersImport(name, path, pos) {
+			return name
+		}
+	}
+	base, known := pkgName(path, ctx.Pkg)
+	name := base
+	if ctx.isVisible(name, []token.Pos{pos}) || ctx.fileImportsName(name) {
+		name = ctx.gensym(base, []token.Pos{pos})
+	}
+	if name == base && known {
+		astutil.AddImport(ctx.Fset, ctx.File, path)
+	} else {
+		astutil.AddNamedImport(ctx.Fset, ctx.File, name, path)
+	}
+	return name
+}
+
+// refersImport checks if name at pos is import of path,
+// imports added by expansion are not in type info
+func (ctx *Context) refersImport(name, path string, pos token.Pos) bool {
+	if ctx.Pkg == nil || ctx.Pkg.Types == nil {
+		return true
+	}
+	scope := ctx.Pkg.Types.Scope().Innermost(pos)
+	if scope == nil {
+		return true
+	}
+	_, obj := scope.LookupParent(name, pos)
+	if obj == nil {
+		return true
+	}
+	pkgName, ok := obj.(*types.PkgName)
+	return ok && pkgName.Imported().Path() == path
+}
+
+// fileImportsName checks if any import of file has name
+func (ctx *Context) fileImportsName(name string) bool {
+	for _, spec := range ctx.File.Imports {
+		if ImportedName(spec, ctx.Pkg) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportPath returns unquoted path of import
+func ImportPath(spec *ast.ImportSpec) string {
+	path, err := strconv.Unquote(spec.Path.Value)
+	if err != nil {
+		return spec.Path.Value
+	}
+	return path
+}
+
+// ImportedName returns name of import in file, package name
+// of imports of pkg or guessed from path if not renamed
+func ImportedName(spec *ast.ImportSpec, pkg *packages.Package) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	name, _ := pkgName(ImportPath(spec), pkg)
+	return name
+}
+
+var majorVersion = regexp.MustCompile(`^v[0-9]+$`)
+
+// pkgName returns name of package path, known is false
+// if name is guessed from path
+func pkgName(path string, pkg *packages.Package) (name string, known bool) {
+	if pkg != nil {
+		if imp, ok := pkg.Imports[path]; ok && imp.Name != "" {
+			return imp.Name, true
+		}
+	}
+	elems := strings.Split(path, "/")
+	name = elems[len(elems)-1]
+	if len(elems) > 1 && majorVersion.MatchString(name) {
+		name = elems[len(elems)-2]
+	}
+	// gopkg.in/yaml.v2
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		name = name[:i]
+	}
+	name = strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	// std packages are named as last path element
+	return name, !strings.Contains(elems[0], ".")
+}
@@ -17,11 +17,11 @@ const LogFuncStubName = "__nooplog_"
 
 // MacroLogExpand transformer for Log_μ
 func MacroLogExpand(
+	ctx *Context,
 	cur *astutil.Cursor,
 	parentStmt ast.Stmt,
 	idents []*ast.Ident,
-	callArgs [][]ast.Expr,
-	pre, post astutil.ApplyFunc) bool {
+	callArgs [][]ast.Expr) bool {
 	if !checkIsMacroIdent(Log_μSymbol, idents) {
 		return false
 	}
@@ -29,28 +29,27 @@ func MacroLogExpand(
 		return false
 	}
 	pos := idents[0].Pos()
-	fileInfo := ApplyState.Fset.File(pos)
+	fileInfo := ctx.Fset.File(pos)
 	fileAndPos := fmt.Sprintf("%s:%d ",
-		strings.TrimPrefix(fileInfo.Name(), ApplyState.SrcDir),
+		strings.TrimPrefix(fileInfo.Name(), ctx.SrcDir),
 		fileInfo.Line(idents[0].Pos()))
 
 	// if enabled check match
-	if ApplyState.LogRe != nil && !ApplyState.LogRe.MatchString(fileAndPos) {
+	if ctx.LogRe != nil && !ctx.LogRe.MatchString(fileAndPos) {
 		// remove
-		if stmt, ok := cur.Node().(*ast.ExprStmt); ok {
-			if callExpr, ok := stmt.X.(*ast.CallExpr); ok {
-				if selExpr, ok := callExpr.Fun.(*ast.SelectorExpr); ok {
-					selExpr.Sel.Name = LogFuncStubName
-					callExpr.Fun = selExpr.Sel
-				}
-			}
+		callExpr := stmtCall(parentStmt)
+		if parentStmt == nil {
+			callExpr, _ = cur.Node().(*ast.CallExpr)
+		}
+		if callExpr != nil {
+			// lib func or its alias
+			callExpr.Fun = &ast.Ident{Name: LogFuncStubName, NamePos: callExpr.Fun.Pos()}
 		}
 		return false
 	}
 	// construct fmt.Printf()
 	fmtExpr := &ast.SelectorExpr{
-		// TODO handle when import renamed
-		X:   &ast.Ident{Name: "fmt"},
+		X:   &ast.Ident{Name: ctx.ImportName("fmt", pos)},
 		Sel: &ast.Ident{Name: "Printf"},
 	}
 	fmtCfg := &ast.BasicLit{
@@ -66,7 +65,7 @@ func MacroLogExpand(
 		default:
 			callName, err := FormatNode(v)
 			if err != nil {
-				fmt.Printf("WARN FormatNode error on type %T\n", v)
+				ctx.Warnf(v.Pos(), CodeFormat, "format argument error %+v", err)
 			}
 			callName = strings.ReplaceAll(callName, "\"", "'")
 			fmtCfg.Value += fmt.Sprintf("%s=%%#v ", callName)
@@ -78,12 +77,15 @@ func MacroLogExpand(
 	}
 	fmtCfg.Value = fmt.Sprintf("\"%s\\n\"", fmtCfg.Value)
 	callExpr := createCallExpr(fmtExpr, args)
-	cur.InsertAfter(&ast.ExprStmt{X: callExpr})
-	astutil.AddImport(ApplyState.Fset, ApplyState.File, "fmt")
-
-	// expand body macros
-	astutil.Apply(callExpr, pre, post)
-	cur.Delete()
+	// map generated code to call site
+	fillPos(callExpr, cur.Node().Pos())
+	ctx.Replaced = append(ctx.Replaced, Span{Pos: cur.Node().Pos(), End: cur.Node().End()})
+	replaceCall(ctx, cur, parentStmt, callExpr)
+	if parentStmt == nil {
+		// expand body macros, macros of statement are expanded
+		// by walk of statement to hoist values before it
+		astutil.Apply(callExpr, ctx.Pre, ctx.Post)
+	}
 	return true
 }
 
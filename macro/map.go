@@ -15,7 +15,7 @@ func MapKeys_μ(keys, m interface{}) {
 
 // MapVals_μ returns map values
 func MapVals_μ(vals, m interface{}) {
-	slVals := &[]_T{}
+	slVals := &[]_G{}
 	dic := map[_T]_G{}
 	for _, v := range dic {
 		*slVals = append(*slVals, v)
@@ -24,9 +24,9 @@ func MapVals_μ(vals, m interface{}) {
 
 // MapToSlice_μ apply f to elements of m to generate sl
 func MapToSlice_μ(sl, m, f interface{}) {
-	slice := &[]interface{}{}
+	slice := &[]_T1{}
 	dic := map[_T]_G{}
-	proc := (func(_T, _G) _T)(nil)
+	proc := (func(_T, _G) _T1)(nil)
 	for k, v := range dic {
 		*slice = append(*slice, proc(k, v))
 	}
@@ -55,3 +55,23 @@ func PrintMapKeys_μ(keys, m interface{}) {
 		fmt.Printf("%v : %v\n", arg1[i], arg2[arg1[i]])
 	}
 }
+
+// Keys_μ returns keys of map m
+func Keys_μ(m interface{}) []_T {
+	dic := map[_T]_G{}
+	keys := make([]_T, 0, len(dic))
+	for k := range dic {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Vals_μ returns values of map m
+func Vals_μ(m interface{}) []_G {
+	dic := map[_T]_G{}
+	vals := make([]_G, 0, len(dic))
+	for _, v := range dic {
+		vals = append(vals, v)
+	}
+	return vals
+}
@@ -0,0 +1,254 @@
+package macro
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// Plugin external executable expanding macros declared in package
+// ImportPath, it is run for each call with PluginRequest as json
+// on stdin and writes PluginResponse as json to stdout
+type Plugin struct {
+	// executable and its args
+	Command []string `json:"command" toml:"command"`
+	// import path of package declaring macros
+	ImportPath string `json:"importPath" toml:"import_path"`
+	// names of macros expanded by plugin
+	Macros []string `json:"macros" toml:"macros"`
+	// timeout of one call as go duration, 10s by default
+	Timeout string `json:"timeout" toml:"timeout"`
+	// working directory of executable
+	Dir string `json:"-" toml:"-"`
+}
+
+// PluginRequest macro call sent to plugin
+type PluginRequest struct {
+	Macro      string `json:"macro"`
+	ImportPath string `json:"importPath"`
+	// file:line:column of call
+	Pos string `json:"pos"`
+	// source of call
+	Source string      `json:"source"`
+	Args   []PluginArg `json:"args"`
+	// set if call is statement and can be replaced by statements,
+	// otherwise it is replaced by expression
+	Stmt bool `json:"stmt"`
+	// signature of enclosing function
+	Func string `json:"func"`
+}
+
+// PluginArg argument of macro call with its type
+type PluginArg struct {
+	Source string `json:"source"`
+	Type   string `json:"type"`
+}
+
+// PluginResponse replacement of macro call returned by plugin
+type PluginResponse struct {
+	// statements or expression replacing call
+	Source string `json:"source"`
+	// import paths of packages used in Source by their names
+	Imports []string `json:"imports"`
+	// error reported at call
+	Error string `json:"error"`
+}
+
+const defaultPluginTimeout = 10 * time.Second
+
+// Expander returns expander running plugin
+func (p Plugin) Expander() (MacroExpander, error) {
+	if len(p.Command) == 0 {
+		return nil, fmt.Errorf("plugin of %s has no command", p.ImportPath)
+	}
+	timeout := defaultPluginTimeout
+	if p.Timeout != "" {
+		d, err := time.ParseDuration(p.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s timeout error %+v", p.Command[0], err)
+		}
+		timeout = d
+	}
+	return func(ctx *Context, cur *astutil.Cursor, parentStmt ast.Stmt,
+		idents []*ast.Ident, callArgs [][]ast.Expr) bool {
+		return p.expand(ctx, cur, parentStmt, idents, callArgs, timeout)
+	}, nil
+}
+
+func (p Plugin) expand(ctx *Context, cur *astutil.Cursor, parentStmt ast.Stmt,
+	idents []*ast.Ident, callArgs [][]ast.Expr, timeout time.Duration) bool {
+	callExpr := stmtCall(parentStmt)
+	if parentStmt == nil {
+		callExpr, _ = cur.Node().(*ast.CallExpr)
+	}
+	if callExpr == nil {
+		return false
+	}
+	name, pos := idents[0].Name, idents[0].Pos()
+	if len(idents) > 1 {
+		ctx.Errorf(pos, CodeInvalidCall, "%s can not be chained", name)
+		return false
+	}
+	src, err := FormatNode(callExpr)
+	if err != nil {
+		ctx.Errorf(pos, CodeFormat, "format call error %+v", err)
+		return false
+	}
+	req := PluginRequest{
+		Macro:      name,
+		ImportPath: p.ImportPath,
+		Pos:        ctx.Fset.Position(pos).String(),
+		Source:     src,
+		Stmt:       parentStmt != nil,
+		Func:       ctx.enclosingFunc(callExpr),
+	}
+	for _, arg := range callArgs[0] {
+		src, err := FormatNode(arg)
+		if err != nil {
+			ctx.Errorf(arg.Pos(), CodeFormat, "format argument error %+v", err)
+			return false
+		}
+		req.Args = append(req.Args, PluginArg{Source: src, Type: ctx.typeString(arg)})
+	}
+	resp, err := p.run(&req, timeout)
+	if err != nil {
+		ctx.Errorf(pos, CodePlugin, "%s plugin %s error %+v", name, p.Command[0], err)
+		return false
+	}
+	if resp.Error != "" {
+		ctx.Errorf(pos, CodePlugin, "%s: %s", name, resp.Error)
+		return false
+	}
+	var node ast.Node
+	if parentStmt != nil {
+		var stmts []ast.Stmt
+		stmts, err = parseStmts(resp.Source)
+		node = &ast.BlockStmt{List: stmts}
+	} else {
+		node, err = parser.ParseExpr(resp.Source)
+	}
+	if err != nil {
+		ctx.Errorf(pos, CodePlugin, "%s plugin source error %+v", name, err)
+		return false
+	}
+	// map generated code to call site
+	node = cloneNode(node, callExpr.Pos())
+	for _, path := range resp.Imports {
+		ctx.renamePkg(node, path, ctx.ImportName(path, pos))
+	}
+	if block, ok := node.(*ast.BlockStmt); ok {
+		// args bound by plugin source are not known, all of it is
+		// run by go or defer
+		replaceStmt(ctx, cur, block, 0)
+	} else {
+		ctx.Replaced = append(ctx.Replaced, Span{Pos: callExpr.Pos(), End: callExpr.End()})
+		cur.Replace(node)
+		if ctx.depth == 1 {
+			ctx.generated = node
+		}
+	}
+	return true
+}
+
+// run runs plugin with req and decodes its response
+func (p Plugin) run(req *PluginRequest, timeout time.Duration) (*PluginResponse, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+	cmd.Dir = p.Dir
+	cmd.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timeout %s exceeded", timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	resp := &PluginResponse{}
+	err = json.Unmarshal(stdout.Bytes(), resp)
+	if err != nil {
+		return nil, fmt.Errorf("response error %+v", err)
+	}
+	return resp, nil
+}
+
+// parseStmts parses statements of func body
+func parseStmts(src string) ([]ast.Stmt, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), "", "package p\nfunc _() {\n"+src+"\n}", 0)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := f.Decls[0].(*ast.FuncDecl)
+	if !ok || len(f.Decls) > 1 {
+		return nil, errors.New("source is not statements")
+	}
+	return fn.Body.List, nil
+}
+
+// renamePkg renames package of path used by default name in node
+func (ctx *Context) renamePkg(node ast.Node, path, name string) {
+	def, _ := pkgName(path, ctx.Pkg)
+	if def == name {
+		return
+	}
+	ast.Inspect(node, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			// package names are not resolved by parser
+			if ident, ok := sel.X.(*ast.Ident); ok && ident.Name == def && ident.Obj == nil {
+				ident.Name = name
+			}
+		}
+		return true
+	})
+}
+
+// typeString returns type of expr relative to package of file
+func (ctx *Context) typeString(expr ast.Expr) string {
+	if ctx.Pkg == nil || ctx.Pkg.TypesInfo == nil {
+		return ""
+	}
+	typ := ctx.Pkg.TypesInfo.TypeOf(expr)
+	if typ == nil {
+		return ""
+	}
+	return types.TypeString(typ, types.RelativeTo(ctx.Pkg.Types))
+}
+
+// enclosingFunc returns signature of func enclosing node
+func (ctx *Context) enclosingFunc(node ast.Node) string {
+	if ctx.Pkg == nil || ctx.Pkg.TypesInfo == nil {
+		return ""
+	}
+	path, _ := astutil.PathEnclosingInterval(ctx.File, node.Pos(), node.End())
+	for _, n := range path {
+		switch fn := n.(type) {
+		case *ast.FuncLit:
+			// generated literals are not in type info
+			if typ := ctx.Pkg.TypesInfo.TypeOf(fn); typ != nil {
+				return types.TypeString(typ, types.RelativeTo(ctx.Pkg.Types))
+			}
+		case *ast.FuncDecl:
+			if obj := ctx.Pkg.TypesInfo.Defs[fn.Name]; obj != nil {
+				return types.ObjectString(obj, types.RelativeTo(ctx.Pkg.Types))
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+package macro
+
+import (
+	"go/ast"
+	"go/token"
+	"reflect"
+)
+
+var (
+	posType   = reflect.TypeOf(token.NoPos)
+	objType   = reflect.TypeOf((*ast.Object)(nil))
+	scopeType = reflect.TypeOf((*ast.Scope)(nil))
+)
+
+// optionalPos position fields where NoPos has meaning
+// and should not be filled
+var optionalPos = map[string]bool{
+	"ast.CallExpr.Ellipsis": true,
+	"ast.TypeSpec.Assign":   true,
+	"ast.GenDecl.Lparen":    true,
+	"ast.GenDecl.Rparen":    true,
+	"ast.ChanType.Arrow":    true,
+	"ast.FieldList.Opening": true,
+	"ast.FieldList.Closing": true,
+	"ast.RangeStmt.TokPos":  true,
+	"ast.ImportSpec.EndPos": true,
+}
+
+// cloneNode deep copies node and sets all valid positions to pos,
+// used to copy macro templates to call site
+// objects and scopes are shared with original node
+func cloneNode(node ast.Node, pos token.Pos) ast.Node {
+	if node == nil {
+		return nil
+	}
+	return clonePos(reflect.ValueOf(node), pos).Interface().(ast.Node)
+}
+
+func clonePos(v reflect.Value, pos token.Pos) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || v.Type() == objType || v.Type() == scopeType {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(clonePos(v.Elem(), pos))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(clonePos(v.Elem(), pos))
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(clonePos(v.Index(i), pos))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).Type() == posType {
+				if token.Pos(v.Field(i).Int()).IsValid() {
+					c.Field(i).Set(reflect.ValueOf(pos))
+				}
+				continue
+			}
+			c.Field(i).Set(clonePos(v.Field(i), pos))
+		}
+		return c
+	}
+	return v
+}
+
+// fillPos sets missing positions of node and its children to pos,
+// used on generated nodes to map them to macro call site
+func fillPos(node ast.Node, pos token.Pos) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		v := reflect.ValueOf(n)
+		if v.Kind() != reflect.Ptr || v.IsNil() {
+			return true
+		}
+		v = v.Elem()
+		if v.Kind() != reflect.Struct {
+			return true
+		}
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			if f.Type() != posType || token.Pos(f.Int()).IsValid() {
+				continue
+			}
+			if optionalPos[v.Type().String()+"."+v.Type().Field(i).Name] {
+				continue
+			}
+			f.Set(reflect.ValueOf(pos))
+		}
+		return true
+	})
+}
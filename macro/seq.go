@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"go/ast"
 	"go/token"
-	"log"
 	"strings"
 
 	"golang.org/x/tools/go/ast/astutil"
@@ -17,8 +16,12 @@ type seq_μ []_T
 type _RF func(_T, _T, int) _T
 type _PF func(_T, int) bool
 type _MF func(_T, int) _T
+
+// placeholders of types inferred from call args,
+// additional ones are named _T1.._Tn
 type _T interface{}
 type _G interface{}
+type _T1 interface{}
 
 // NewSeq_μ constructs new sequence and scope
 // src must be slice and passed by value
@@ -85,8 +88,8 @@ func Filter_μ(in, out, fn interface{}) {
 // Map_μ (in, out) pointers to slices and fn func(_T [, int]) _G
 func Map_μ(in, out, fn interface{}) {
 	input := []_T{}
-	res := &([]_T{})
-	fun := (_MF)(nil)
+	res := &([]_G{})
+	fun := (func(_T, int) _G)(nil)
 	for i := range input {
 		*res = append(*res, fun(input[i], i))
 	}
@@ -95,8 +98,8 @@ func Map_μ(in, out, fn interface{}) {
 // Reduce_μ in pointer/value to slice, out pointer *_G and fn func(_G, _T [, int]) _G
 func Reduce_μ(in, out, fn interface{}) {
 	input := []_T{}
-	accum := (*_T)(nil)
-	fun := (_RF)(nil)
+	accum := (*_G)(nil)
+	fun := (func(_G, _T, int) _G)(nil)
 	for i := range input {
 		*accum = fun(*accum, input[i], i)
 	}
@@ -104,11 +107,11 @@ func Reduce_μ(in, out, fn interface{}) {
 
 // MacroNewSeq macro expander for sequence M/F/R
 func MacroNewSeq(
+	ctx *Context,
 	cur *astutil.Cursor,
 	parentStmt ast.Stmt,
 	idents []*ast.Ident,
-	callArgs [][]ast.Expr,
-	pre, post astutil.ApplyFunc) bool {
+	callArgs [][]ast.Expr) bool {
 
 	var newSeqBlocks []ast.Stmt
 	var lastNewSeqStmt ast.Stmt
@@ -132,9 +135,13 @@ func MacroNewSeq(
 	// handle newseq call without chaining
 	if len(idents) == 1 && idents[0].Name == "NewSeq_μ" {
 		// used as variable, add import
-		ApplyState.RemoveLib = false
+		ctx.RemoveLib = false
 		return true
 	}
+	if parentStmt == nil {
+		ctx.Errorf(idents[0].Pos(), CodeInvalidCall, "%s can not be used in expression", idents[0].Name)
+		return false
+	}
 	for i := 0; i < len(idents); i++ {
 		reusePrevSeq := false
 		ident := idents[i]
@@ -142,16 +149,17 @@ func MacroNewSeq(
 		var funDecl *ast.FuncDecl
 		if ident.Obj == nil {
 			name := fmt.Sprintf("%s.%s", Seq_μTypeSymbol, ident.Name)
-			funDecl = MacroDecl[name]
+			funDecl = ctx.Decls[MacroKey(MacroPkgPath, name)]
 			if funDecl == nil {
-				fmt.Printf("WARN Method Decl not found %+v\n", name)
-				continue
+				ctx.Errorf(ident.Pos(), CodeUnknownMethod, "unknown method %s", name)
+				return false
 			}
 		} else {
 			var ok bool
 			funDecl, ok = ident.Obj.Decl.(*ast.FuncDecl)
 			if !ok {
-				log.Fatalf("funDecl expected but got %+v", ident.Obj.Decl)
+				ctx.Errorf(ident.Pos(), CodeInvalidCall, "%s is not a macro func", ident.Name)
+				return false
 			}
 		}
 
@@ -183,12 +191,13 @@ func MacroNewSeq(
 				case *ast.FuncLit:
 					funcType = fn.Type
 				default:
-					obj := resolveExpr(fn, ApplyState.Pkg)
+					obj := resolveExpr(fn, ctx.Pkg)
 					if obj != nil && obj.Decl != nil {
 						decl := obj.Decl.(*ast.FuncDecl)
 						funcType = decl.Type
 					} else {
-						fmt.Printf("Currently unsupported Expr for MFR %T\n", fn)
+						ctx.Errorf(fn.Pos(), CodeInvalidArg,
+							"%s expects func argument", ident.Name)
 						return false
 					}
 				}
@@ -208,10 +217,11 @@ func MacroNewSeq(
 					funcType.Params.List = append(funcType.Params.List,
 						&ast.Field{
 							Names: []*ast.Ident{
-								{Name: "_"}, // ignored
+								{Name: "_", NamePos: funcType.Params.Closing}, // ignored
 							},
 							Type: &ast.Ident{
-								Name: "int",
+								Name:    "int",
+								NamePos: funcType.Params.Closing,
 							},
 						})
 					if funLit != nil {
@@ -259,8 +269,9 @@ func MacroNewSeq(
 			}
 		}
 
+		// position stage code at its call to map errors to it
 		body := copyBodyStmt(len(callArgs[i]),
-			funDecl.Body, true)
+			funDecl.Body, true, ident.Pos())
 		// find all body args defined as assignments
 		var bodyArgs []*ast.AssignStmt
 		for _, ln := range body.List {
@@ -272,7 +283,10 @@ func MacroNewSeq(
 		// switch Rhs with call args
 		// TODO support multiple declaration in one line
 		for i, carg := range callArgs[i] {
-			bodyArgs[i].Rhs = []ast.Expr{carg}
+			setArgRhs(bodyArgs[i], carg)
+		}
+		if !ctx.resolveTemplateRefs(ident, body, callArgs[i], ident.Pos()) {
+			return false
 		}
 		if reusePrevSeq {
 			// create extra assignment out = &prevSeq
@@ -286,14 +300,14 @@ func MacroNewSeq(
 			stmt := createAssignStmt([]ast.Expr{&ast.Ident{
 				Name: fmt.Sprintf("%s%d", "seq", len(newSeqBlocks)-1),
 			}}, []ast.Expr{
-				&ast.UnaryExpr{
-					Op: token.MUL, X: &ast.Ident{Name: "out"},
+				&ast.StarExpr{
+					X: &ast.Ident{Name: "out"},
 				}}, token.ASSIGN)
 			// inject stmt after Filtering stage
 			body.List = append(body.List, stmt)
 		}
 		// expand body macros
-		astutil.Apply(body, pre, post)
+		astutil.Apply(body, ctx.Pre, ctx.Post)
 		// New funcs which returns macro type should have parent scope
 		if strings.HasPrefix(funDecl.Name.Name, "New") {
 			newSeqBlocks = body.List
@@ -305,7 +319,8 @@ func MacroNewSeq(
 
 	if len(blocks) > 0 {
 		blockStmt := new(ast.BlockStmt)
-		blockStmt.Lbrace = cur.Node().End()
+		blockStmt.Lbrace = cur.Node().Pos()
+		blockStmt.Rbrace = cur.Node().End()
 		if newSeqBlocks != nil {
 			blockStmt.List = append(blockStmt.List, newSeqBlocks...)
 			newSeqBlocks = nil
@@ -313,9 +328,10 @@ func MacroNewSeq(
 			lastNewSeqSeq = nil
 		}
 		blockStmt.List = append(blockStmt.List, blocks...)
+		// map generated code to call site
+		fillPos(blockStmt, cur.Node().Pos())
 		// insert as one block
-		cur.InsertAfter(blockStmt)
-		cur.Delete()
+		replaceStmt(ctx, cur, blockStmt, len(callArgs[0]))
 	}
 
 	return true
@@ -0,0 +1,146 @@
+package macro
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// MacroKey returns key of macro or macro type method name
+// declared in package path
+func MacroKey(path, name string) string {
+	return path + "." + name
+}
+
+// pkgRef import path of package referred by ident of macro template,
+// stored in ident object as templates are copied with objects
+type pkgRef string
+
+// markRefs marks package names and package level objects used
+// in body and results of macro decl with import path of their packages
+func markRefs(decl *ast.FuncDecl, pkg *packages.Package) {
+	if decl.Body == nil || pkg.TypesInfo == nil || pkg.Types == nil {
+		return
+	}
+	mark := func(n ast.Node) bool {
+		ident, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		switch obj := pkg.TypesInfo.Uses[ident].(type) {
+		case nil:
+		case *types.PkgName:
+			ident.Obj = &ast.Object{Kind: ast.Pkg, Name: ident.Name,
+				Data: pkgRef(obj.Imported().Path())}
+		default:
+			if obj.Pkg() != pkg.Types || obj.Parent() != pkg.Types.Scope() {
+				break
+			}
+			kind, objDecl := ast.Bad, interface{}(nil)
+			if ident.Obj != nil {
+				kind, objDecl = ident.Obj.Kind, ident.Obj.Decl
+			}
+			ident.Obj = &ast.Object{Kind: kind, Name: ident.Name,
+				Decl: objDecl, Data: pkgRef(pkg.PkgPath)}
+		}
+		return true
+	}
+	ast.Inspect(decl.Body, mark)
+	// results of value macros are declared at call site
+	if decl.Type.Results != nil {
+		ast.Inspect(decl.Type.Results, mark)
+	}
+}
+
+// refPath returns import path marked on ident by markRefs,
+// pkg is set if ident is package name
+func refPath(ident *ast.Ident) (path string, pkg bool) {
+	if ident.Obj == nil {
+		return "", false
+	}
+	ref, ok := ident.Obj.Data.(pkgRef)
+	if !ok {
+		return "", false
+	}
+	return string(ref), ident.Obj.Kind == ast.Pkg
+}
+
+// macroPath returns import path of package of macro called by
+// ident, qualified is set if ident is package name
+func (ctx *Context) macroPath(ident *ast.Ident) (path string, qualified bool) {
+	if ctx.Pkg != nil && ctx.Pkg.TypesInfo != nil {
+		switch obj := ctx.Pkg.TypesInfo.Uses[ident].(type) {
+		case *types.PkgName:
+			return obj.Imported().Path(), true
+		case *types.Func:
+			if obj.Pkg() != nil {
+				return obj.Pkg().Path(), false
+			}
+		}
+	}
+	// generated code is not in type info
+	if path, pkg := refPath(ident); path != "" {
+		return path, pkg
+	}
+	if ident.Name == ctx.MacroLibName && ident.Obj == nil {
+		return MacroPkgPath, true
+	}
+	return MacroPkgPath, false
+}
+
+// resolveTemplateRefs renames packages used in template copied
+// from macro package to their names in file at pos and qualifies
+// package level objects of other macro package, call args in
+// template are user code, unexported objects of other package
+// are reported as invalid decl of macro called by ident
+func (ctx *Context) resolveTemplateRefs(ident *ast.Ident, node ast.Node, args []ast.Expr, pos token.Pos) bool {
+	ok := true
+	user := map[ast.Node]bool{}
+	for _, arg := range args {
+		user[arg] = true
+	}
+	astutil.Apply(node, func(cur *astutil.Cursor) bool {
+		if user[cur.Node()] {
+			return false
+		}
+		ref, isIdent := cur.Node().(*ast.Ident)
+		if !isIdent {
+			return true
+		}
+		path, isPkg := refPath(ref)
+		switch {
+		case path == "":
+		case isPkg && isMacroSelector(cur.Parent()):
+			// expanded by path of ident
+		case isPkg:
+			// package names are not resolved in file
+			ref.Name = ctx.ImportName(path, pos)
+			ref.Obj = nil
+		case ctx.Pkg != nil && path == ctx.Pkg.PkgPath:
+			// declared in file package
+		case strings.HasSuffix(ref.Name, MacroSymbol):
+			// expanded by path of ident
+		case !ast.IsExported(ref.Name):
+			// can not be referred from file package
+			ctx.Errorf(ident.Pos(), CodeInvalidDecl, "%s refers to unexported %s of package %s", ident.Name, ref.Name, path)
+			ok = false
+		default:
+			cur.Replace(&ast.SelectorExpr{
+				X:   &ast.Ident{Name: ctx.ImportName(path, pos), NamePos: ref.Pos()},
+				Sel: &ast.Ident{Name: ref.Name, NamePos: ref.Pos()},
+			})
+		}
+		return true
+	}, nil)
+	return ok
+}
+
+// isMacroSelector checks if node selects macro of package
+func isMacroSelector(node ast.Node) bool {
+	sel, ok := node.(*ast.SelectorExpr)
+	return ok && strings.HasSuffix(sel.Sel.Name, MacroSymbol)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"go/ast"
 	"go/token"
+	"go/types"
 	"strings"
 
 	"golang.org/x/tools/go/ast/astutil"
@@ -17,11 +18,11 @@ const tryErrName = "_tryerr_"
 
 // MacroTryExpand try macro expander
 func MacroTryExpand(
+	ctx *Context,
 	cur *astutil.Cursor,
 	parentStmt ast.Stmt,
 	idents []*ast.Ident,
-	callArgs [][]ast.Expr,
-	pre, post astutil.ApplyFunc) bool {
+	callArgs [][]ast.Expr) bool {
 	if !checkIsMacroIdent(Try_μSymbol, idents) {
 		return false
 	}
@@ -32,14 +33,15 @@ func MacroTryExpand(
 	// func lit is arg of try
 	funcLit, ok := callArgs[0][0].(*ast.FuncLit)
 	if !ok {
-		fmt.Printf("WARN expected Try macro, got %+v\n", callArgs[0]) // output for debug
+		ctx.Errorf(callArgs[0][0].Pos(), CodeInvalidArg, "%s expects func literal argument", Try_μSymbol)
 		return false
 	}
-	// expected assignstmt
-	pstmt := parentStmt.(*ast.AssignStmt)
-
 	// create new err variable
 	errDecl, errIdent := createDeclStmt(token.VAR, tryErrName, &ast.Ident{Name: "error"})
+	// new ident for each use to keep own position
+	errRef := func() *ast.Ident {
+		return &ast.Ident{Name: errIdent.Name, Obj: errIdent.Obj}
+	}
 	var procRecur func([]ast.Stmt) []ast.Stmt
 	depth := 0
 	// check all errors in all statements recursively
@@ -66,7 +68,10 @@ func MacroTryExpand(
 					continue OUTER
 				}
 
-				obj := resolveExpr(cexp.Fun, ApplyState.Pkg)
+				obj := resolveExpr(cexp.Fun, ctx.Pkg)
+				if obj == nil {
+					continue OUTER // conversion
+				}
 				funcDecl := obj.Decl.(*ast.FuncDecl)
 				// check if it is error
 				lastReturnType := funcDecl.Type.Results.
@@ -76,7 +81,8 @@ func MacroTryExpand(
 						continue OUTER
 					}
 				} else {
-					fmt.Printf("WARN Try macro unexpected type %T\n", lastReturnType)
+					ctx.Warnf(cexp.Pos(), CodeUncheckedCall, "%s does not check result of type %s",
+						Try_μSymbol, types.ExprString(lastReturnType))
 					continue OUTER
 
 				}
@@ -85,7 +91,10 @@ func MacroTryExpand(
 				if cexp, ok = rstmt.X.(*ast.CallExpr); !ok {
 					continue OUTER
 				}
-				obj := resolveExpr(cexp.Fun, ApplyState.Pkg)
+				obj := resolveExpr(cexp.Fun, ctx.Pkg)
+				if obj == nil {
+					continue OUTER // conversion
+				}
 				funcDecl := obj.Decl.(*ast.FuncDecl)
 				// check if it is error
 				if len(funcDecl.Type.Results.List) == 0 {
@@ -98,7 +107,8 @@ func MacroTryExpand(
 						continue OUTER
 					}
 				} else {
-					fmt.Printf("WARN Try macro unexpected type %T\n", lastReturnType)
+					ctx.Warnf(cexp.Pos(), CodeUncheckedCall, "%s does not check result of type %s",
+						Try_μSymbol, types.ExprString(lastReturnType))
 					continue OUTER
 
 				}
@@ -139,17 +149,19 @@ func MacroTryExpand(
 			}
 			// replace with err
 			if len(assignStmt.Lhs) > 0 {
-				assignStmt.Lhs[len(assignStmt.Lhs)-1] = errIdent
+				assignStmt.Lhs[len(assignStmt.Lhs)-1] = errRef()
 			} else {
-				assignStmt.Lhs = []ast.Expr{errIdent}
+				assignStmt.Lhs = []ast.Expr{errRef()}
 			}
+			// map generated code to checked statement
+			fillPos(assignStmt, stmt.Pos())
 			fmtCfg := &ast.BasicLit{
 				Kind:  token.STRING,
 				Value: "",
 			}
 			callName, err := FormatNode(cexp)
 			if err != nil {
-				fmt.Printf("WARN FormatNode error on type %T\n", cexp)
+				ctx.Warnf(cexp.Pos(), CodeFormat, "format call error %+v", err)
 			} else {
 				// do not include args
 				idx := strings.LastIndexByte(callName, '(')
@@ -159,29 +171,35 @@ func MacroTryExpand(
 				}
 			}
 			fmtExpr := &ast.SelectorExpr{
-				X:   &ast.Ident{Name: "fmt"},
+				X:   &ast.Ident{Name: ctx.ImportName("fmt", stmt.Pos())},
 				Sel: &ast.Ident{Name: "Errorf"},
 			}
-			callExpr := createCallExpr(fmtExpr, []ast.Expr{fmtCfg, errIdent})
-			bodyList = append(bodyList, createIfErrRetStmt(errIdent, callExpr))
+			callExpr := createCallExpr(fmtExpr, []ast.Expr{fmtCfg, errRef()})
+			ifStmt := createIfErrRetStmt(errRef(), callExpr)
+			fillPos(ifStmt, stmt.Pos())
+			bodyList = append(bodyList, ifStmt)
 		}
 		return bodyList
 	}
 	// add top level var err decl
+	fillPos(errDecl, funcLit.Body.Lbrace)
 	stmts := []ast.Stmt{errDecl}
 	stmts = append(stmts, procRecur(funcLit.Body.List)...)
 
 	// last element should be return, set to tryerr if nil
 	if ret, ok := stmts[len(stmts)-1].(*ast.ReturnStmt); ok {
 		if ident, ok := ret.Results[0].(*ast.Ident); ok && ident.Name == "nil" {
-			ret.Results[0] = errIdent
+			ret.Results[0] = errRef()
+			fillPos(ret, ret.Pos())
 		}
 	}
 	funcLit.Body.List = stmts
 	callExpr := createCallExpr(funcLit, nil)
-	pstmt.Rhs = []ast.Expr{callExpr}
+	fillPos(callExpr, funcLit.End())
+	// called in place to keep evaluation order
+	replaceCall(ctx, cur, parentStmt, callExpr)
 	// expand body macros
-	astutil.Apply(callExpr, pre, post)
+	astutil.Apply(callExpr, ctx.Pre, ctx.Post)
 
 	return true
 }
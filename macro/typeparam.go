@@ -0,0 +1,267 @@
+package macro
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"regexp"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// placeholderRe matches names of placeholder types of templates
+// _T, _G and _T1.._Tn declared as interface{}
+var placeholderRe = regexp.MustCompile(`^_(T[0-9]*|G)$`)
+
+// argType type of template arg pattern, stored in object of arg
+// name as templates are copied with objects
+type argType struct {
+	typ types.Type
+}
+
+// markArgTypes marks names of template args with types of their
+// patterns with placeholders
+func markArgTypes(decl *ast.FuncDecl, pkg *packages.Package) {
+	if decl.Body == nil || pkg.TypesInfo == nil {
+		return
+	}
+	for _, st := range decl.Body.List {
+		assign, ok := st.(*ast.AssignStmt)
+		if !ok || len(assign.Lhs) != 1 || len(assign.Rhs) != 1 {
+			continue
+		}
+		ident, ok := assign.Lhs[0].(*ast.Ident)
+		if !ok || ident.Obj == nil {
+			continue
+		}
+		typ := pkg.TypesInfo.TypeOf(assign.Rhs[0])
+		if typ != nil && hasPlaceholder(typ, map[types.Type]bool{}) {
+			ident.Obj.Data = argType{typ}
+		}
+	}
+}
+
+// isPlaceholder checks if typ is placeholder type
+func isPlaceholder(typ types.Type) bool {
+	named, ok := typ.(*types.Named)
+	if !ok || !placeholderRe.MatchString(named.Obj().Name()) {
+		return false
+	}
+	_, ok = named.Underlying().(*types.Interface)
+	return ok
+}
+
+// hasPlaceholder checks if typ refers to placeholder type
+func hasPlaceholder(typ types.Type, seen map[types.Type]bool) bool {
+	if seen[typ] {
+		return false
+	}
+	seen[typ] = true
+	switch t := typ.(type) {
+	case *types.Named:
+		// template types like _PF refer to placeholders
+		return isPlaceholder(t) || hasPlaceholder(t.Underlying(), seen)
+	case *types.Pointer:
+		return hasPlaceholder(t.Elem(), seen)
+	case *types.Slice:
+		return hasPlaceholder(t.Elem(), seen)
+	case *types.Array:
+		return hasPlaceholder(t.Elem(), seen)
+	case *types.Chan:
+		return hasPlaceholder(t.Elem(), seen)
+	case *types.Map:
+		return hasPlaceholder(t.Key(), seen) || hasPlaceholder(t.Elem(), seen)
+	case *types.Signature:
+		return hasPlaceholder(t.Params(), seen) || hasPlaceholder(t.Results(), seen)
+	case *types.Tuple:
+		for i := 0; i < t.Len(); i++ {
+			if hasPlaceholder(t.At(i).Type(), seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unify binds placeholders of pattern to types at same place in
+// actual, parts of different shape are skipped as template args
+// are interface{}, bind reports conflicting binding
+func unify(pattern, actual types.Type, bind func(name string, typ types.Type) bool) bool {
+	if isPlaceholder(pattern) {
+		return bind(pattern.(*types.Named).Obj().Name(), actual)
+	}
+	if named, ok := pattern.(*types.Named); ok {
+		if types.Identical(named, actual) {
+			return true
+		}
+		pattern = named.Underlying()
+	}
+	actual = actual.Underlying()
+	switch p := pattern.(type) {
+	case *types.Pointer:
+		if a, ok := actual.(*types.Pointer); ok {
+			return unify(p.Elem(), a.Elem(), bind)
+		}
+	case *types.Slice:
+		if a, ok := actual.(*types.Slice); ok {
+			return unify(p.Elem(), a.Elem(), bind)
+		}
+	case *types.Array:
+		if a, ok := actual.(*types.Array); ok {
+			return unify(p.Elem(), a.Elem(), bind)
+		}
+	case *types.Chan:
+		if a, ok := actual.(*types.Chan); ok {
+			return unify(p.Elem(), a.Elem(), bind)
+		}
+	case *types.Map:
+		if a, ok := actual.(*types.Map); ok {
+			return unify(p.Key(), a.Key(), bind) && unify(p.Elem(), a.Elem(), bind)
+		}
+	case *types.Signature:
+		a, ok := actual.(*types.Signature)
+		if !ok || a.Results().Len() != p.Results().Len() {
+			break
+		}
+		// index param is optional
+		for i := 0; i < p.Params().Len() && i < a.Params().Len(); i++ {
+			if !unify(p.Params().At(i).Type(), a.Params().At(i).Type(), bind) {
+				return false
+			}
+		}
+		for i := 0; i < p.Results().Len(); i++ {
+			if !unify(p.Results().At(i).Type(), a.Results().At(i).Type(), bind) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// substTypeParams infers types of placeholders from types of call
+// args bound to template args and substitutes them in body,
+// ambiguous and not inferred placeholders are errors
+func (ctx *Context) substTypeParams(ident *ast.Ident, body *ast.BlockStmt,
+	bodyArgs []*ast.AssignStmt, args []ast.Expr) bool {
+	bound := map[string]types.Type{}
+	argOf := map[string]int{}
+	for i, arg := range args {
+		if i >= len(bodyArgs) {
+			break
+		}
+		pattern := templateArgType(bodyArgs[i])
+		actual := ctx.exprType(arg)
+		if pattern == nil || actual == nil {
+			continue
+		}
+		ok := unify(pattern, actual, func(name string, typ types.Type) bool {
+			prev, ok := bound[name]
+			if !ok {
+				bound[name], argOf[name] = typ, i
+				return true
+			}
+			if types.Identical(prev, typ) {
+				return true
+			}
+			ctx.Errorf(ident.Pos(), CodeTypeParam, "%s: ambiguous type of %s, %s by argument %d and %s by argument %d",
+				ident.Name, name, ctx.qualifiedType(prev), argOf[name]+1, ctx.qualifiedType(typ), i+1)
+			return false
+		})
+		if !ok {
+			return false
+		}
+	}
+	user := map[ast.Node]bool{}
+	for _, arg := range args {
+		user[arg] = true
+	}
+	ok := true
+	astutil.Apply(body, func(cur *astutil.Cursor) bool {
+		if user[cur.Node()] || !ok {
+			return false
+		}
+		id, isIdent := cur.Node().(*ast.Ident)
+		if !isIdent || !placeholderRe.MatchString(id.Name) {
+			return true
+		}
+		// placeholders are types of template package
+		if path, isPkg := refPath(id); path == "" || isPkg {
+			return true
+		}
+		typ, found := bound[id.Name]
+		if !found {
+			ctx.Errorf(ident.Pos(), CodeTypeParam, "%s: can not infer type of %s", ident.Name, id.Name)
+			ok = false
+			return false
+		}
+		expr, err := ctx.typeExpr(typ, ident.Pos())
+		if err != nil {
+			ctx.Errorf(ident.Pos(), CodeTypeParam, "%s: type %s of %s error %+v",
+				ident.Name, ctx.qualifiedType(typ), id.Name, err)
+			ok = false
+			return false
+		}
+		cur.Replace(expr)
+		return true
+	}, nil)
+	return ok
+}
+
+// templateArgType returns type of pattern of template arg
+func templateArgType(assign *ast.AssignStmt) types.Type {
+	if len(assign.Lhs) != 1 {
+		return nil
+	}
+	ident, ok := assign.Lhs[0].(*ast.Ident)
+	if !ok || ident.Obj == nil {
+		return nil
+	}
+	if arg, ok := ident.Obj.Data.(argType); ok {
+		return arg.typ
+	}
+	return nil
+}
+
+// exprType returns type of expr in file, untyped constants
+// have default types
+func (ctx *Context) exprType(expr ast.Expr) types.Type {
+	if ctx.Pkg == nil || ctx.Pkg.TypesInfo == nil {
+		return nil
+	}
+	typ := ctx.Pkg.TypesInfo.TypeOf(expr)
+	if typ == nil {
+		return nil
+	}
+	if basic, ok := typ.(*types.Basic); ok && basic.Kind() == types.UntypedNil {
+		return nil
+	}
+	return types.Default(typ)
+}
+
+// qualifiedType returns typ with packages qualified by path
+func (ctx *Context) qualifiedType(typ types.Type) string {
+	var qf types.Qualifier
+	if ctx.Pkg != nil {
+		qf = types.RelativeTo(ctx.Pkg.Types)
+	}
+	return types.TypeString(typ, qf)
+}
+
+// typeExpr returns expression of typ with packages named
+// as imported in file at pos
+func (ctx *Context) typeExpr(typ types.Type, pos token.Pos) (ast.Expr, error) {
+	src := types.TypeString(typ, func(p *types.Package) string {
+		if ctx.Pkg != nil && p == ctx.Pkg.Types {
+			return ""
+		}
+		return ctx.ImportName(p.Path(), pos)
+	})
+	expr, err := parser.ParseExpr(src)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s error %+v", src, err)
+	}
+	return cloneNode(expr, pos).(ast.Expr), nil
+}
@@ -0,0 +1,264 @@
+package macro
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"reflect"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// frame node walked by Pre, statements of blocks collect
+// statements hoisted before them
+type frame struct {
+	node ast.Node
+	// statement in list of block or clause body
+	stmt bool
+	// root of walk, generated code walked before insertion
+	root    bool
+	hoisted []ast.Stmt
+}
+
+func newFrame(cur *astutil.Cursor) *frame {
+	f := &frame{node: cur.Node(), root: cur.Name() == "Node" && cur.Index() < 0}
+	if _, ok := cur.Node().(ast.Stmt); ok && cur.Index() >= 0 {
+		switch cur.Node().(type) {
+		case *ast.CaseClause, *ast.CommClause:
+		default:
+			f.stmt = true
+		}
+	}
+	return f
+}
+
+// cursorNode returns node at position of cursor, Node of cursor
+// is not changed by Replace and Delete
+func cursorNode(cur *astutil.Cursor) ast.Node {
+	v := reflect.Indirect(reflect.ValueOf(cur.Parent())).FieldByName(cur.Name())
+	if i := cur.Index(); i >= 0 {
+		if i >= v.Len() {
+			return nil
+		}
+		v = v.Index(i)
+	}
+	n, _ := v.Interface().(ast.Node)
+	return n
+}
+
+// isValueMacro checks if macro returns value which is not
+// macro type of chain
+func isValueMacro(decl *ast.FuncDecl) bool {
+	results := decl.Type.Results
+	return results != nil && results.NumFields() == 1 &&
+		!strings.Contains(types.ExprString(results.List[0].Type), MacroSymbol)
+}
+
+// expandValue expands macro called in expression, body is hoisted
+// as block before statement and assigns result to new var
+// replacing call
+func expandValue(ctx *Context, cur *astutil.Cursor, idents []*ast.Ident, callArgs [][]ast.Expr) bool {
+	ident := idents[0]
+	decl := ident.Obj.Decl.(*ast.FuncDecl)
+	callExpr, ok := cur.Node().(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	if len(idents) > 1 {
+		ctx.Errorf(ident.Pos(), CodeInvalidCall, "%s result can not be chained", ident.Name)
+		return false
+	}
+	target := ctx.hoistFrame(callExpr)
+	if target == nil {
+		ctx.Errorf(ident.Pos(), CodeInvalidCall,
+			"%s can not be hoisted before statement preserving evaluation order", ident.Name)
+		return false
+	}
+	pos := callExpr.Pos()
+	body := copyBodyStmt(len(callArgs[0]), decl.Body, false, pos)
+	var bodyArgs []*ast.AssignStmt
+	for _, ln := range body.List {
+		if st, ok := ln.(*ast.AssignStmt); ok {
+			bodyArgs = append(bodyArgs, st)
+		}
+	}
+	if len(bodyArgs) < len(callArgs[0]) {
+		ctx.Errorf(ident.Pos(), CodeInvalidArg, "%s expects %d arguments", ident.Name, len(bodyArgs))
+		return false
+	}
+	for i, carg := range callArgs[0] {
+		setArgRhs(bodyArgs[i], carg)
+	}
+	result := decl.Type.Results.List[0]
+	name := ctx.gensym("result", []token.Pos{pos})
+	declStmt, _ := createDeclStmt(token.VAR, name, cloneNode(result.Type, pos).(ast.Expr))
+	var named *ast.Ident
+	if len(result.Names) == 1 {
+		// named result is declared in body
+		named = result.Names[0]
+		namedDecl, _ := createDeclStmt(token.VAR, named.Name, cloneNode(result.Type, pos).(ast.Expr))
+		body.List = append([]ast.Stmt{namedDecl}, body.List...)
+	}
+	ctx.assignReturns(body, name, named)
+	hoisted := &ast.BlockStmt{List: []ast.Stmt{declStmt, body}}
+	if !ctx.substTypeParams(ident, hoisted, bodyArgs, callArgs[0]) {
+		return false
+	}
+	if !ctx.resolveTemplateRefs(ident, hoisted, callArgs[0], pos) {
+		return false
+	}
+	// expand body macros
+	astutil.Apply(body, ctx.Pre, ctx.Post)
+	// map generated code to call site
+	fillPos(hoisted, pos)
+	target.hoisted = append(target.hoisted, hoisted.List...)
+	ctx.Replaced = append(ctx.Replaced, Span{Pos: callExpr.Pos(), End: callExpr.End()})
+	cur.Replace(&ast.Ident{Name: name, NamePos: pos})
+	if ctx.depth == 1 {
+		ctx.generated = body
+	}
+	return true
+}
+
+// assignReturns replaces returns of body by assignment of result
+// to var name, returns before end of body jump to its end
+func (ctx *Context) assignReturns(body *ast.BlockStmt, name string, named *ast.Ident) {
+	var label string
+	last := len(body.List) - 1
+	astutil.Apply(body, func(cur *astutil.Cursor) bool {
+		var value ast.Expr
+		switch n := cur.Node().(type) {
+		case *ast.FuncLit:
+			// returns of func literal
+			return false
+		case *ast.ReturnStmt:
+			if len(n.Results) > 0 {
+				value = n.Results[0]
+			} else if named != nil {
+				value = &ast.Ident{Name: named.Name}
+			}
+		default:
+			return true
+		}
+		assign := createAssignStmt([]ast.Expr{&ast.Ident{Name: name}},
+			[]ast.Expr{value}, token.ASSIGN)
+		if cur.Parent() == body && cur.Index() == last {
+			cur.Replace(assign)
+			return false
+		}
+		if label == "" {
+			label = ctx.gensym("end", []token.Pos{body.Pos()})
+		}
+		cur.Replace(&ast.BlockStmt{List: []ast.Stmt{assign,
+			&ast.BranchStmt{Tok: token.GOTO, Label: &ast.Ident{Name: label}}}})
+		return false
+	}, nil)
+	if label != "" {
+		// goto does not jump over declarations of body block
+		body.List = []ast.Stmt{&ast.BlockStmt{List: body.List},
+			&ast.LabeledStmt{Label: &ast.Ident{Name: label}, Stmt: &ast.EmptyStmt{Implicit: true}}}
+	}
+}
+
+// hoistFrame returns frame of statement before which call in
+// expression is evaluated first, nil if hoisting the call changes
+// evaluation order of statement
+func (ctx *Context) hoistFrame(call *ast.CallExpr) *frame {
+	i := len(ctx.frames) - 1
+	for ; i >= 0 && !ctx.frames[i].stmt; i-- {
+		if ctx.frames[i].root {
+			return nil
+		}
+	}
+	if i < 0 {
+		return nil
+	}
+	path := ctx.frames[i:]
+	ancestors := map[ast.Node]bool{}
+	for j, f := range path {
+		ancestors[f.node] = true
+		var child ast.Node = call
+		if j+1 < len(path) {
+			child = path[j+1].node
+		}
+		if !evaluatedOnce(f.node, child) {
+			return nil
+		}
+	}
+	if ctx.evaluatedBefore(path[0].node, call, ancestors) {
+		return nil
+	}
+	return path[0]
+}
+
+// evaluatedOnce checks if child of node is evaluated once
+// before rest of statement
+func evaluatedOnce(node, child ast.Node) bool {
+	switch n := node.(type) {
+	case *ast.BinaryExpr:
+		return child != n.Y || n.Op != token.LAND && n.Op != token.LOR
+	case *ast.IfStmt:
+		return child == n.Init || child == n.Cond && n.Init == nil
+	case *ast.SwitchStmt:
+		return child == n.Init || child == n.Tag && n.Init == nil
+	case *ast.TypeSwitchStmt:
+		return child == n.Init || child == n.Assign && n.Init == nil
+	case *ast.ForStmt:
+		return child == n.Init
+	case *ast.RangeStmt:
+		return child == n.X
+	case *ast.SelectStmt, *ast.BlockStmt, *ast.FuncLit:
+		return false
+	}
+	return true
+}
+
+// evaluatedBefore checks if calls or receives of stmt other than
+// ancestors of call are evaluated before call
+func (ctx *Context) evaluatedBefore(stmt, call ast.Node, ancestors map[ast.Node]bool) bool {
+	found, before := false, false
+	ast.Inspect(stmt, func(n ast.Node) bool {
+		if found || before || n == nil {
+			return false
+		}
+		switch v := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.CallExpr:
+			if v == call {
+				found = true
+				return false
+			}
+			before = !ancestors[v] && !ctx.isPureCall(v)
+		case *ast.UnaryExpr:
+			before = v.Op == token.ARROW && !ancestors[v]
+		}
+		return true
+	})
+	return before
+}
+
+// pureBuiltins builtins without side effects
+var pureBuiltins = map[string]bool{
+	"append": true, "cap": true, "complex": true, "imag": true, "len": true,
+	"make": true, "max": true, "min": true, "new": true, "real": true,
+}
+
+// isPureCall checks if call is conversion or builtin call
+// without side effects
+func (ctx *Context) isPureCall(call *ast.CallExpr) bool {
+	if ctx.Pkg != nil && ctx.Pkg.TypesInfo != nil {
+		if tv, ok := ctx.Pkg.TypesInfo.Types[call.Fun]; ok {
+			if tv.IsType() {
+				return true
+			}
+			if !tv.IsBuiltin() {
+				return false
+			}
+		}
+	}
+	// builtins and generated code are not in type info
+	ident, ok := astutil.Unparen(call.Fun).(*ast.Ident)
+	return ok && ident.Obj == nil && pureBuiltins[ident.Name]
+}
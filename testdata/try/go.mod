@@ -1,9 +0,0 @@
-module gpp.com/try
-
-go 1.13
-
-require (
-	github.com/kr/pretty v0.2.0 // indirect
-	github.com/mmirolim/gpp v0.0.0-20200213103918-53695eb9c953
-	golang.org/x/tools v0.0.0-20200213224642-88e652f7a869 // indirect
-)